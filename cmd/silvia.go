@@ -1,14 +1,32 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/Qlean/silvia/silvia"
 )
 
 func main() {
-	worker := &silvia.Worker{}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "check" {
+		configCheck(os.Args[3:])
+		return
+	}
+
+	configPath := flag.String("config", os.Getenv("SILVIA_CONFIG"), "Config file (.yaml, .yml or .toml)")
+	flag.Parse()
+
+	worker := &silvia.Worker{ConfigPath: *configPath}
 	err := worker.Load()
 	if err != nil {
 		log.Fatal(err)
@@ -16,13 +34,87 @@ func main() {
 
 	http.Handle("/v1/status", worker.ApiHandler(silvia.StatusApi))
 	http.Handle("/v1/ring", worker.ApiHandler(silvia.RingApi))
+	http.Handle("/metrics", worker.ApiHandler(silvia.MetricsApi))
 
 	go worker.Generator()
 	go worker.Transformer()
-	go worker.Writer("postgres")
-	go worker.Writer("redshift")
+	go worker.Writer()
 	go worker.Killer()
+	go worker.WatchConfig()
 
 	log.Println("Server running on port:", worker.Config.Port)
-	http.ListenAndServe(":"+worker.Config.Port, nil)
+	http.ListenAndServe(":"+strconv.Itoa(worker.Config.Port), nil)
+}
+
+// replay re-ingests raw payloads of a tracker from a single source
+func replay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("SILVIA_CONFIG"), "Config file (.yaml, .yml or .toml)")
+	tracker := flags.String("tracker", "", "Tracker payloads belong to (e.g. snowplow)")
+	file := flags.String("file", "", "Read a raw payload per line from file")
+	table := flags.String("table", "", "Read error_event of rows failed to transform or validate from tracker table in sink database (postgres or redshift)")
+	errorTypes := flags.String("error-types", "Transform,Schema", "Comma-separated error_type of rows read with -table")
+	queue := flags.String("queue", "", "Read RabbitMQ queue until it's empty (e.g. dead-letter queue)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: silvia replay -tracker NAME (-file PATH | -table SINK | -queue NAME)")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var sources []silvia.ReplaySource
+	if *file != "" {
+		sources = append(sources, &silvia.FileSource{Path: *file})
+	}
+	if *table != "" {
+		sources = append(sources, &silvia.TableSource{Sink: *table, ErrorTypes: strings.Split(*errorTypes, ",")})
+	}
+	if *queue != "" {
+		sources = append(sources, &silvia.QueueSource{Queue: *queue})
+	}
+	if *tracker == "" || len(sources) != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	worker := &silvia.Worker{ConfigPath: *configPath}
+	err := worker.LoadReplay()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	results, err := worker.Replay(*tracker, sources[0])
+	if results != nil {
+		log.Printf("Replayed %d events, %d failed", results.Written, results.Failed)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if results.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// configCheck resolves config from all layers and prints effective value
+// of every key with the layer it comes from
+func configCheck(args []string) {
+	flags := flag.NewFlagSet("config check", flag.ExitOnError)
+	configPath := flags.String("config", os.Getenv("SILVIA_CONFIG"), "Config file (.yaml, .yml or .toml)")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: silvia config check [-config PATH]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	config, _, err := silvia.LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid config:", err)
+		os.Exit(1)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "KEY\tVALUE\tSOURCE")
+	for _, value := range config.Display() {
+		fmt.Fprintf(writer, "%s\t%s\t%s\n", value.Key, value.Value, value.Source)
+	}
+	writer.Flush()
 }
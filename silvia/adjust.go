@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
+	"fmt"
 	"net/url"
 	"reflect"
 	"strconv"
@@ -22,6 +23,7 @@ type (
 	AdjustEvent struct {
 		Body       []byte         `db:"-"`
 		Id         int            `db:"-"`
+		Delivery   *Delivery      `db:"-" json:"-"`
 		Aid        sql.NullString `db:"app_id"`
 		An         sql.NullString `db:"app_name"`
 		Av         sql.NullString `db:"app_version"`
@@ -98,28 +100,44 @@ func (nt NullTime) Value() (driver.Value, error) {
 	return nt.Time, nil
 }
 
-func (event *AdjustEvent) Transform(request []byte) error {
-	event.Body = request
+func (event *AdjustEvent) GetDelivery() *Delivery {
+	return event.Delivery
+}
 
-	normString, err := strconv.Unquote(`"` + string(request) + `"`)
-	if err != nil {
-		return err
-	}
+func (event *AdjustEvent) SetDelivery(delivery *Delivery) {
+	event.Delivery = delivery
+}
 
-	normString = strings.Replace(normString, "\" ", "", -1)
-	adjustRequest := &AdjustRequest{}
-	err = json.Unmarshal([]byte(normString), adjustRequest)
-	if err == nil {
-		request = []byte(adjustRequest.Request)[4 : len(adjustRequest.Request)-9]
+// DedupKey is device, event token and creation time, which are the same
+// for every callback of an event
+func (event *AdjustEvent) DedupKey() string {
+	if !event.Adid.Valid || !event.Ct.Valid {
+		return ""
 	}
+	return event.Adid.String + "/" + event.Et.String + "/" + event.Ct.Time.UTC().Format(time.RFC3339Nano)
+}
 
-	u, err := url.Parse(string(request))
+func (event *AdjustEvent) SetError(errType string, err error, raw []byte) {
+	checkStringForNull(errType, &event.ErrType)
+	checkStringForNull(err.Error(), &event.Error)
+	checkStringForNull(fmt.Sprintf("%#v", string(raw)), &event.ErrorEvent)
+}
+
+func (event *AdjustEvent) Failure(errType string, err error) Event {
+	failure := &AdjustEvent{Body: event.Body, Delivery: event.Delivery}
+	failure.SetError(errType, err, event.Body)
+	return failure
+}
+
+func (event *AdjustEvent) Transform(request []byte) (err error) {
+	defer recoverTransform(&err)
+	event.Body = request
+
+	queryParams, err := adjustQuery(request)
 	if err != nil {
 		return err
 	}
 
-	queryParams := u.Query()
-
 	structType := reflect.TypeOf(*event)
 	structValue := reflect.ValueOf(event).Elem()
 
@@ -165,3 +183,29 @@ func (event *AdjustEvent) Transform(request []byte) error {
 
 	return nil
 }
+
+// adjustQuery returns callback parameters of nginx log line or of a bare
+// request URI
+func adjustQuery(request []byte) (url.Values, error) {
+	normString, err := strconv.Unquote(`"` + string(request) + `"`)
+	if err != nil {
+		return nil, err
+	}
+
+	normString = strings.Replace(normString, "\" ", "", -1)
+	adjustRequest := &AdjustRequest{}
+	err = json.Unmarshal([]byte(normString), adjustRequest)
+	if err == nil {
+		// Request line is "GET <uri> HTTP/1.1"
+		if len(adjustRequest.Request) < 13 {
+			return nil, fmt.Errorf("Invalid request line %q", adjustRequest.Request)
+		}
+		request = []byte(adjustRequest.Request)[4 : len(adjustRequest.Request)-9]
+	}
+
+	u, err := url.Parse(string(request))
+	if err != nil {
+		return nil, err
+	}
+	return u.Query(), nil
+}
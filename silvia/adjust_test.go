@@ -1048,6 +1048,26 @@ func TestAdjustTransform(t *testing.T) {
 	}
 }
 
+var adjustRequestLineResults = []struct {
+	title   string
+	request string
+	err     string
+}{
+	{`Request line`, `{\x22request\x22:\x22GET /?ip=1.1.1.1 HTTP/1.1\x22}`, ""},
+	{`Short request line`, `{\x22request\x22:\x22GET\x22}`, `Invalid request line "GET"`},
+	{`Empty request line`, `{\x22request\x22:\x22\x22}`, `Invalid request line ""`},
+}
+
+func TestAdjustRequestLine(t *testing.T) {
+	for _, testCase := range adjustRequestLineResults {
+		event := &AdjustEvent{}
+		err := event.Transform([]byte(testCase.request))
+		if testCase.err == "" && err != nil || testCase.err != "" && (err == nil || err.Error() != testCase.err) {
+			t.Errorf("Failed on: %s\nExpected error %q, got %v", testCase.title, testCase.err, err)
+		}
+	}
+}
+
 func PrintAdjust(t *testing.T) {
 	for i, adjustString := range testStrings {
 		event := &AdjustEvent{}
@@ -10,25 +10,14 @@ import (
 )
 
 type Status struct {
-	RabbitHealth   bool
-	PostgresHealth bool
-	RedshiftHealth bool
-
-	AdjustSuccess   int
-	AdjustFailed    int
-	SnowplowSuccess int
-	SnowplowFailed  int
-
-	RedshiftAdjustSuccess   int
-	RedshiftAdjustFailed    int
-	RedshiftSnowplowSuccess int
-	RedshiftSnowplowFailed  int
-
-	PostgresAdjustSuccess   int
-	PostgresAdjustFailed    int
-	PostgresSnowplowSuccess int
-	PostgresSnowplowFailed  int
-	Uptime                  string
+	RabbitHealth bool
+
+	Trackers map[string]TrackerStatus
+	Sinks    map[string]SinkStatus
+
+	ConfigChanges RingSnapshot[ConfigChange]
+
+	Uptime string
 }
 
 func (worker *Worker) ApiHandler(fn func(http.ResponseWriter, *http.Request, *Worker)) http.HandlerFunc {
@@ -42,41 +31,28 @@ func StatusApi(w http.ResponseWriter, r *http.Request, worker *Worker) {
 
 	stats := worker.Stats
 
-	adjustSuccessRing := stats.AdjustSuccessRing.Display()
-	adjustFailRing := stats.AdjustFailRing.Display()
-	snowplowSuccessRing := stats.SnowplowSuccessRing.Display()
-	snowplowFailRing := stats.SnowplowFailRing.Display()
+	status := Status{
+		RabbitHealth: stats.RabbitHealth.Get(),
 
-	RedshiftadjustSuccessRing := stats.RedshiftAdjustSuccessRing.Display()
-	RedshiftadjustFailRing := stats.RedshiftAdjustFailRing.Display()
-	RedshiftsnowplowSuccessRing := stats.RedshiftSnowplowSuccessRing.Display()
-	RedshiftsnowplowFailRing := stats.RedshiftSnowplowFailRing.Display()
+		Trackers: map[string]TrackerStatus{},
+		Sinks:    map[string]SinkStatus{},
 
-	PostgresadjustSuccessRing := stats.PostgresAdjustSuccessRing.Display()
-	PostgresadjustFailRing := stats.PostgresAdjustFailRing.Display()
-	PostgressnowplowSuccessRing := stats.PostgresSnowplowSuccessRing.Display()
-	PostgressnowplowFailRing := stats.PostgresSnowplowFailRing.Display()
+		Uptime: time.Since(stats.StartTime).String(),
+	}
 
-	status := Status{
-		RabbitHealth:    stats.RabbitHealth.Get(),
-		PostgresHealth:  stats.PostgresHealth.Get(),
-		RedshiftHealth:  stats.RedshiftHealth.Get(),
-		AdjustSuccess:   adjustSuccessRing.Total,
-		AdjustFailed:    adjustFailRing.Total,
-		SnowplowSuccess: snowplowSuccessRing.Total,
-		SnowplowFailed:  snowplowFailRing.Total,
-
-		RedshiftAdjustSuccess:   RedshiftadjustSuccessRing.Total,
-		RedshiftAdjustFailed:    RedshiftadjustFailRing.Total,
-		RedshiftSnowplowSuccess: RedshiftsnowplowSuccessRing.Total,
-		RedshiftSnowplowFailed:  RedshiftsnowplowFailRing.Total,
-
-		PostgresAdjustSuccess:   PostgresadjustSuccessRing.Total,
-		PostgresAdjustFailed:    PostgresadjustFailRing.Total,
-		PostgresSnowplowSuccess: PostgressnowplowSuccessRing.Total,
-		PostgresSnowplowFailed:  PostgressnowplowFailRing.Total,
+	for _, tracker := range worker.Trackers {
+		status.Trackers[tracker.Tracker.Name()] = tracker.Status()
+	}
 
-		Uptime: time.Since(stats.StartTime).String(),
+	if worker.ConfigChanges != nil {
+		status.ConfigChanges = worker.ConfigChanges.Display()
+	}
+
+	healthy := status.RabbitHealth
+	for _, sink := range worker.sinks() {
+		sinkStatus := sink.Status()
+		status.Sinks[sink.Name] = sinkStatus
+		healthy = healthy && sinkStatus.Health
 	}
 
 	b, err := json.MarshalIndent(status, "", "  ")
@@ -87,32 +63,74 @@ func StatusApi(w http.ResponseWriter, r *http.Request, worker *Worker) {
 
 	httpStatus := http.StatusOK
 
-	if !status.RabbitHealth || !status.PostgresHealth {
+	if !healthy {
 		httpStatus = http.StatusTooManyRequests
 	}
 
 	rndr.Text(w, httpStatus, string(b))
 }
 
+// MetricsApi exposes pipeline metrics in Prometheus text format
+func MetricsApi(w http.ResponseWriter, r *http.Request, worker *Worker) {
+	requestBusDepth := NewGaugeVec("silvia_request_bus_depth", "Messages waiting for transform.", "tracker")
+	sinkBusDepth := NewGaugeVec("silvia_sink_bus_depth", "Events waiting to be written to sink.", "sink", "tracker")
+	rabbitUp := NewGaugeVec("silvia_rabbit_up", "Whether RabbitMQ is connected.")
+	sinkUp := NewGaugeVec("silvia_sink_up", "Whether sink is connected.", "sink")
+	spillBytes := NewGaugeVec("silvia_spill_bytes", "Size of events kept on disk for sink.", "sink")
+
+	rabbitUp.Set(boolToFloat(worker.Stats.RabbitHealth.Get()))
+	for _, tracker := range worker.Trackers {
+		requestBusDepth.Set(float64(len(tracker.RequestBus)), tracker.Tracker.Name())
+	}
+	for _, sink := range worker.sinks() {
+		sinkUp.Set(boolToFloat(sink.Health.Get()), sink.Name)
+		if sink.Spill != nil {
+			spillBytes.Set(float64(sink.Spill.Status().Bytes), sink.Name)
+		}
+		for name, bus := range sink.Buses {
+			sinkBusDepth.Set(float64(len(bus.Events)), sink.Name, name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	metrics.Expose(w)
+	requestBusDepth.Expose(w)
+	sinkBusDepth.Expose(w)
+	rabbitUp.Expose(w)
+	sinkUp.Expose(w)
+	spillBytes.Expose(w)
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
 func RingApi(w http.ResponseWriter, r *http.Request, worker *Worker) {
 	var ring []interface{}
 	u, _ := url.Parse(r.URL.String())
 	queryParams := u.Query()
-	switch queryParams.Get("tracker") {
-	case "snowplow":
-		switch queryParams.Get("ring") {
-		case "success":
-			ring = append(ring, worker.Stats.SnowplowSuccessRing.Display(), worker.Stats.PostgresSnowplowSuccessRing.Display(), worker.Stats.RedshiftSnowplowSuccessRing.Display())
-		case "failed":
-			ring = append(ring, worker.Stats.SnowplowFailRing.Display(), worker.Stats.PostgresSnowplowFailRing.Display(), worker.Stats.RedshiftSnowplowFailRing.Display())
+	name := queryParams.Get("tracker")
+
+	for _, tracker := range worker.Trackers {
+		if tracker.Tracker.Name() != name {
+			continue
 		}
 
-	case "adjust":
 		switch queryParams.Get("ring") {
 		case "success":
-			ring = append(ring, worker.Stats.AdjustSuccessRing.Display(), worker.Stats.PostgresAdjustSuccessRing.Display(), worker.Stats.RedshiftAdjustSuccessRing.Display())
+			ring = append(ring, tracker.SuccessRing.Display())
+			for _, sink := range worker.sinks() {
+				ring = append(ring, sink.Buses[name].SuccessRing.Display())
+			}
 		case "failed":
-			ring = append(ring, worker.Stats.AdjustFailRing.Display(), worker.Stats.PostgresAdjustFailRing.Display(), worker.Stats.RedshiftAdjustFailRing.Display())
+			ring = append(ring, tracker.FailRing.Display())
+			for _, sink := range worker.sinks() {
+				ring = append(ring, sink.Buses[name].FailRing.Display())
+			}
 		}
 	}
 
@@ -0,0 +1,220 @@
+package silvia
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type (
+	// ArchiveRecord is a raw message as it's kept in archive, a record
+	// per line. Body is base64 encoded if it's not valid UTF-8. Spilled
+	// messages keep indexes of their events dropped as duplicates.
+	ArchiveRecord struct {
+		Received   time.Time `json:"received"`
+		Tracker    string    `json:"tracker"`
+		Body       string    `json:"body,omitempty"`
+		BodyBase64 []byte    `json:"body_base64,omitempty"`
+		Dropped    []int     `json:"dropped,omitempty"`
+	}
+
+	// Archive is a sink keeping raw messages in gzip NDJSON files under
+	// Dir, a file per tracker per hour: <tracker>/2006-01-02/15.ndjson.gz
+	Archive struct {
+		sync.Mutex
+		Dir   string
+		files map[string]*archiveFile
+		now   func() time.Time
+	}
+
+	archiveFile struct {
+		path string
+		file *os.File
+		gzip *gzip.Writer
+	}
+)
+
+func init() {
+	RegisterSink("archive", SinkDriver{
+		New:   func() Sink { return &Archive{} },
+		Batch: BatchLimits{MaxRows: 100, MaxBytes: 4 << 20, MaxAge: time.Second},
+		Raw:   true,
+	})
+}
+
+func newArchiveRecord(delivery *Delivery) *ArchiveRecord {
+	record := &ArchiveRecord{Received: delivery.Received, Tracker: delivery.Tracker}
+	if utf8.Valid(delivery.Body) {
+		record.Body = string(delivery.Body)
+	} else {
+		record.BodyBase64 = delivery.Body
+	}
+	return record
+}
+
+// Payload returns raw message of the record
+func (record *ArchiveRecord) Payload() []byte {
+	if record.BodyBase64 != nil {
+		return record.BodyBase64
+	}
+	return []byte(record.Body)
+}
+
+func (archive *Archive) Connect(config *Config) error {
+	if config.ArchiveDir == "" {
+		return errors.New("archive_dir is not set")
+	}
+
+	archive.Dir = config.ArchiveDir
+	archive.files = map[string]*archiveFile{}
+	if archive.now == nil {
+		archive.now = time.Now
+	}
+	return os.MkdirAll(archive.Dir, 0755)
+}
+
+// Ping checks archive directory is still there
+func (archive *Archive) Ping() error {
+	info, err := os.Stat(archive.Dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", archive.Dir)
+	}
+	return nil
+}
+
+// Write appends raw messages events were transformed from, each message
+// once however its events are batched. Batch is flushed and synced to disk
+// before it's reported written.
+func (archive *Archive) Write(table Table, events []Event) error {
+	archive.Lock()
+	defer archive.Unlock()
+
+	lines := map[string]*bytes.Buffer{}
+	var deliveries []*Delivery
+	for _, event := range events {
+		delivery := event.GetDelivery()
+		// Nothing to archive for events not built from a message
+		if delivery == nil || delivery.isArchived() || inDeliveries(deliveries, delivery) {
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+
+		line, err := json.Marshal(newArchiveRecord(delivery))
+		if err != nil {
+			return err
+		}
+		if lines[delivery.Tracker] == nil {
+			lines[delivery.Tracker] = &bytes.Buffer{}
+		}
+		lines[delivery.Tracker].Write(line)
+		lines[delivery.Tracker].WriteByte('\n')
+	}
+
+	for tracker, buffer := range lines {
+		file, err := archive.open(tracker)
+		if err != nil {
+			return err
+		}
+		_, err = file.gzip.Write(buffer.Bytes())
+		if err == nil {
+			err = file.gzip.Flush()
+		}
+		if err == nil {
+			err = file.file.Sync()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, delivery := range deliveries {
+		delivery.setArchived()
+	}
+	return nil
+}
+
+func (delivery *Delivery) isArchived() bool {
+	delivery.Lock()
+	defer delivery.Unlock()
+	return delivery.archived
+}
+
+func (delivery *Delivery) setArchived() {
+	delivery.Lock()
+	delivery.archived = true
+	delivery.Unlock()
+}
+
+func inDeliveries(deliveries []*Delivery, delivery *Delivery) bool {
+	for _, item := range deliveries {
+		if item == delivery {
+			return true
+		}
+	}
+	return false
+}
+
+// open returns file of the current hour for tracker, closing the previous
+// one. Files are appended, every open starts a new gzip member.
+func (archive *Archive) open(tracker string) (*archiveFile, error) {
+	now := archive.now().UTC()
+	path := filepath.Join(archive.Dir, tracker, now.Format("2006-01-02"), now.Format("15")+".ndjson.gz")
+
+	file := archive.files[tracker]
+	if file != nil && file.path == path {
+		return file, nil
+	}
+	if file != nil {
+		delete(archive.files, tracker)
+		err := file.close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	file = &archiveFile{path: path, file: f, gzip: gzip.NewWriter(f)}
+	archive.files[tracker] = file
+	return file, nil
+}
+
+func (archive *Archive) Close() error {
+	archive.Lock()
+	defer archive.Unlock()
+
+	var err error
+	for tracker, file := range archive.files {
+		delete(archive.files, tracker)
+		if closeErr := file.close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+func (file *archiveFile) close() error {
+	err := file.gzip.Close()
+	if err != nil {
+		file.file.Close()
+		return err
+	}
+	return file.file.Close()
+}
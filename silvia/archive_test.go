@@ -0,0 +1,145 @@
+package silvia
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestArchive(t *testing.T, now *time.Time) (*Archive, func()) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive := &Archive{now: func() time.Time { return *now }}
+	err = archive.Connect(&Config{ArchiveDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive, func() { os.RemoveAll(dir) }
+}
+
+func readArchive(t *testing.T, path string) []*ArchiveRecord {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var records []*ArchiveRecord
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		record := &ArchiveRecord{}
+		err = json.Unmarshal(scanner.Bytes(), record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	if err = scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func archivedEvent(tracker string, body string) Event {
+	received := time.Date(2016, 4, 15, 17, 46, 55, 0, time.UTC)
+	return &AdjustEvent{Delivery: &Delivery{Tracker: tracker, Body: []byte(body), Received: received}}
+}
+
+func TestArchiveWrite(t *testing.T) {
+	now := time.Date(2016, 4, 15, 17, 59, 0, 0, time.UTC)
+	archive, cleanup := newTestArchive(t, &now)
+	defer cleanup()
+
+	table := Table{Schema: "adjust", Name: "events"}
+	err := archive.Write(table, []Event{archivedEvent("adjust", "/stats/adjust?aid=1"), archivedEvent("adjust", "binary\xff")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Next hour goes to a new file
+	now = now.Add(2 * time.Minute)
+	err = archive.Write(table, []Event{archivedEvent("adjust", "/stats/adjust?aid=2"), &AdjustEvent{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopened file gets a new gzip member
+	err = archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive.Connect(&Config{ArchiveDir: archive.Dir})
+	archive.Write(table, []Event{archivedEvent("adjust", "/stats/adjust?aid=3")})
+	archive.Close()
+
+	first := readArchive(t, filepath.Join(archive.Dir, "adjust", "2016-04-15", "17.ndjson.gz"))
+	if len(first) != 2 {
+		t.Fatalf("Expected 2 records in first hour, got %d", len(first))
+	}
+	if first[0].Body != "/stats/adjust?aid=1" || first[0].Tracker != "adjust" || !first[0].Received.Equal(time.Date(2016, 4, 15, 17, 46, 55, 0, time.UTC)) {
+		t.Errorf("Unexpected record: %+v", first[0])
+	}
+	if first[1].Body != "" || string(first[1].Payload()) != "binary\xff" {
+		t.Errorf("Invalid UTF-8 body must be kept as is: %+v", first[1])
+	}
+
+	second := readArchive(t, filepath.Join(archive.Dir, "adjust", "2016-04-15", "18.ndjson.gz"))
+	if len(second) != 2 || second[0].Body != "/stats/adjust?aid=2" || second[1].Body != "/stats/adjust?aid=3" {
+		t.Errorf("Unexpected records in second hour: %v", second)
+	}
+}
+
+func TestArchiveDelivery(t *testing.T) {
+	now := time.Date(2016, 4, 15, 17, 0, 0, 0, time.UTC)
+	archive, cleanup := newTestArchive(t, &now)
+	defer cleanup()
+
+	// Events of a batched request, split across batches
+	event := archivedEvent("snowplow", "batch")
+	delivery := event.GetDelivery()
+	table := Table{Schema: "atomic", Name: "events"}
+	for _, batch := range [][]Event{{event, &SnowplowEvent{Delivery: delivery}}, {&SnowplowEvent{Delivery: delivery}}} {
+		err := archive.Write(table, batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive.Close()
+
+	records := readArchive(t, filepath.Join(archive.Dir, "snowplow", "2016-04-15", "17.ndjson.gz"))
+	if len(records) != 1 || records[0].Body != "batch" {
+		t.Errorf("Message must be archived once, got %v", records)
+	}
+}
+
+func TestReplayArchive(t *testing.T) {
+	now := time.Date(2016, 4, 15, 17, 0, 0, 0, time.UTC)
+	archive, cleanup := newTestArchive(t, &now)
+	defer cleanup()
+
+	archive.Write(Table{}, []Event{archivedEvent("adjust", transformResults[0].request), archivedEvent("adjust", "%zz")})
+	archive.Close()
+
+	sink := &testSink{batches: map[Table][][]Event{}}
+	worker := newTestReplayWorker(sink)
+	results, err := worker.Replay("adjust", &FileSource{Path: filepath.Join(archive.Dir, "adjust", "2016-04-15", "17.ndjson.gz")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Written != 1 || results.Failed != 1 {
+		t.Errorf("Unexpected results: %d written, %d failed", results.Written, results.Failed)
+	}
+}
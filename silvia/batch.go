@@ -0,0 +1,75 @@
+package silvia
+
+import (
+	"database/sql/driver"
+	"time"
+)
+
+type (
+	// BatchLimits define when a Redshift batch is flushed: whichever of
+	// rows count, estimated size or age of the oldest event comes first.
+	BatchLimits struct {
+		MaxRows  int
+		MaxBytes int
+		MaxAge   time.Duration
+	}
+
+	BatchStatus struct {
+		MaxRows  int
+		MaxBytes int
+		MaxAge   string
+	}
+)
+
+var (
+	defaultAdjustBatch   = BatchLimits{MaxRows: 30, MaxBytes: 4 << 20, MaxAge: 10 * time.Second}
+	defaultSnowplowBatch = BatchLimits{MaxRows: 50, MaxBytes: 4 << 20, MaxAge: 10 * time.Second}
+)
+
+// batchLimits overrides defaults with non-zero config values
+func batchLimits(rows int, bytes int, age time.Duration, defaults BatchLimits) BatchLimits {
+	limits := defaults
+	if rows != 0 {
+		limits.MaxRows = rows
+	}
+	if bytes != 0 {
+		limits.MaxBytes = bytes
+	}
+	if age != 0 {
+		limits.MaxAge = age
+	}
+	return limits
+}
+
+func (limits BatchLimits) Status() BatchStatus {
+	return BatchStatus{
+		MaxRows:  limits.MaxRows,
+		MaxBytes: limits.MaxBytes,
+		MaxAge:   limits.MaxAge.String(),
+	}
+}
+
+// Full reports whether batch of rows events with size bytes must be flushed
+func (limits BatchLimits) Full(rows int, size int) bool {
+	return rows >= limits.MaxRows || size >= limits.MaxBytes
+}
+
+// eventSize estimates size of event values as they are sent to Redshift
+func eventSize(event interface{}) int {
+	size := 0
+	for _, value := range getEventValues(event) {
+		if valuer, ok := value.(driver.Valuer); ok {
+			value, _ = valuer.Value()
+		}
+		switch value := value.(type) {
+		case nil:
+		case string:
+			size += len(value)
+		case []byte:
+			size += len(value)
+		default:
+			size += 8
+		}
+	}
+	return size
+}
@@ -0,0 +1,54 @@
+package silvia
+
+import (
+	"testing"
+	"time"
+)
+
+var batchLimitsResults = []struct {
+	title    string
+	rows     int
+	bytes    int
+	age      time.Duration
+	expected BatchLimits
+}{
+	{`Defaults`, 0, 0, 0, defaultSnowplowBatch},
+	{`Rows only`, 100, 0, 0, BatchLimits{100, defaultSnowplowBatch.MaxBytes, defaultSnowplowBatch.MaxAge}},
+	{`All limits`, 10, 1024, time.Minute, BatchLimits{10, 1024, time.Minute}},
+}
+
+func TestBatchLimits(t *testing.T) {
+	for _, testCase := range batchLimitsResults {
+		limits := batchLimits(testCase.rows, testCase.bytes, testCase.age, defaultSnowplowBatch)
+		if limits != testCase.expected {
+			t.Errorf("Failed on: %s\nLimits: %+v\nExpected: %+v", testCase.title, limits, testCase.expected)
+		}
+	}
+}
+
+func TestBatchLimitsFull(t *testing.T) {
+	limits := BatchLimits{MaxRows: 2, MaxBytes: 100, MaxAge: time.Second}
+	if limits.Full(1, 99) {
+		t.Errorf("Batch under limits must not be full")
+	}
+	if !limits.Full(2, 0) {
+		t.Errorf("Batch must be full by rows")
+	}
+	if !limits.Full(1, 100) {
+		t.Errorf("Batch must be full by bytes")
+	}
+}
+
+func TestEventSize(t *testing.T) {
+	empty := eventSize(&AdjustEvent{})
+	if empty != 0 {
+		t.Errorf("Empty adjust event must have zero size, got %d", empty)
+	}
+
+	event := &AdjustEvent{}
+	checkStringForNull("com.qlean.qlean", &event.An)
+	checkIntForNull("1", &event.Org)
+	if size := eventSize(event); size != len("com.qlean.qlean")+8 {
+		t.Errorf("Unexpected event size %d", size)
+	}
+}
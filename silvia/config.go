@@ -0,0 +1,634 @@
+package silvia
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Prefix of Consul KV keys and, upper-cased, of environment variables
+const configPrefix = "silvia"
+
+// DSN is a PostgreSQL connection string, either key=value pairs or
+// postgres:// URL
+type DSN string
+
+var (
+	dsnType      = reflect.TypeOf(DSN(""))
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// Config is resolved from layers, every next one overrides the previous:
+// default tags, config file, SILVIA_<KEY> environment variables and
+// silvia/<key> Consul KV. Keys tagged local are not read from Consul.
+//
+// Values are parsed by field type, empty value resets the field to zero.
+// Zero batch limits fall back to sink defaults. Integers can be bounded
+// with min and max tags, strings limited with oneof, secret values are
+// masked in Display. Keys tagged hot are applied to running worker when
+// they change in Consul, see Worker.WatchConfig.
+type Config struct {
+	ConsulEnabled  bool   `consul:"consul_enabled,local" default:"true"`
+	ConsulAddr     string `consul:"consul_addr,local" default:"127.0.0.1:8500"`
+	ConsulRegister bool   `consul:"consul_register,local" default:"true"`
+
+	PostgresEnabled bool          `consul:"postgres_enabled" hot:"true"`
+	RedshiftEnabled bool          `consul:"redshift_enabled" hot:"true"`
+	Port            int           `consul:"port" default:"8080" min:"1" max:"65535"`
+	PostgresConnect DSN           `consul:"postgres_connect"`
+	RedshiftConnect DSN           `consul:"redshift_connect"`
+	RingSize        int           `consul:"ring_size" default:"10" min:"1" hot:"true"`
+	RabbitAddr      string        `consul:"rabbit_addr" default:"localhost"`
+	RabbitPort      int           `consul:"rabbit_port" default:"5672" min:"1" max:"65535"`
+	DrainTimeout    time.Duration `consul:"drain_timeout" default:"30s"`
+	DedupWindow     time.Duration `consul:"dedup_window" default:"10m"`
+	RedshiftLoader  string        `consul:"redshift_loader" default:"insert" oneof:"insert copy"`
+	RedshiftIamRole string        `consul:"redshift_iam_role"`
+	S3Endpoint      string        `consul:"s3_endpoint"`
+	S3Region        string        `consul:"s3_region"`
+	S3Bucket        string        `consul:"s3_bucket"`
+	S3Prefix        string        `consul:"s3_prefix"`
+	S3AccessKey     string        `consul:"s3_access_key"`
+	S3SecretKey     string        `consul:"s3_secret_key" secret:"true"`
+
+	DeadLetterExchange string `consul:"dead_letter_exchange"`
+	SpillDir           string `consul:"spill_dir"`
+	SpillMaxBytes      int    `consul:"spill_max_bytes" default:"1073741824" min:"1"`
+	SpillSegmentBytes  int    `consul:"spill_segment_bytes" default:"16777216" min:"1"`
+	ArchiveEnabled     bool   `consul:"archive_enabled" hot:"true"`
+	ArchiveDir         string `consul:"archive_dir"`
+	IgluDir            string `consul:"iglu_dir"`
+
+	// Batch rows stay within half of rabbitPrefetch as sink buses buffer
+	// as many events as the batch
+	PostgresAdjustBatchRows    int           `consul:"postgres_adjust_batch_rows" max:"250" hot:"true"`
+	PostgresAdjustBatchBytes   int           `consul:"postgres_adjust_batch_bytes" hot:"true"`
+	PostgresAdjustBatchAge     time.Duration `consul:"postgres_adjust_batch_age" hot:"true"`
+	PostgresSnowplowBatchRows  int           `consul:"postgres_snowplow_batch_rows" max:"250" hot:"true"`
+	PostgresSnowplowBatchBytes int           `consul:"postgres_snowplow_batch_bytes" hot:"true"`
+	PostgresSnowplowBatchAge   time.Duration `consul:"postgres_snowplow_batch_age" hot:"true"`
+	RedshiftAdjustBatchRows    int           `consul:"redshift_adjust_batch_rows" max:"250" hot:"true"`
+	RedshiftAdjustBatchBytes   int           `consul:"redshift_adjust_batch_bytes" hot:"true"`
+	RedshiftAdjustBatchAge     time.Duration `consul:"redshift_adjust_batch_age" hot:"true"`
+	RedshiftSnowplowBatchRows  int           `consul:"redshift_snowplow_batch_rows" max:"250" hot:"true"`
+	RedshiftSnowplowBatchBytes int           `consul:"redshift_snowplow_batch_bytes" hot:"true"`
+	RedshiftSnowplowBatchAge   time.Duration `consul:"redshift_snowplow_batch_age" hot:"true"`
+
+	// Layer every key was last set from, shown by Display
+	sources map[string]string
+}
+
+// ConfigValue is a resolved config key as it's displayed
+type ConfigValue struct {
+	Key    string
+	Value  string
+	Source string
+}
+
+// LoadConfig resolves config from all layers, file at path is skipped if
+// path is empty. Returns Consul client if Consul is enabled.
+func LoadConfig(path string) (*Config, *consul.Client, error) {
+	local, err := loadLocalConfig(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resolveConfig(local)
+}
+
+// loadLocalConfig resolves every layer but Consul
+func loadLocalConfig(path string) (*Config, error) {
+	config := &Config{}
+	err := config.fillFromDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		err = config.fillFromFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = config.fillFromEnv(os.LookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// resolveConfig returns copy of local config overridden with Consul KV
+// if it's enabled
+func resolveConfig(local *Config) (*Config, *consul.Client, error) {
+	config := local.clone()
+
+	var client *consul.Client
+	if config.ConsulEnabled {
+		var err error
+		client, err = consul.NewClient(&consul.Config{
+			Address: config.ConsulAddr,
+			Scheme:  "http",
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = config.fillFromConsul(client, configPrefix)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err := config.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, client, nil
+}
+
+func (config *Config) clone() *Config {
+	clone := *config
+	clone.sources = map[string]string{}
+	for key, source := range config.sources {
+		clone.sources[key] = source
+	}
+	return &clone
+}
+
+// configKey returns key of the field and whether it's local only
+func configKey(field reflect.StructField) (string, bool) {
+	key := field.Tag.Get("consul")
+	if strings.HasSuffix(key, ",local") {
+		return strings.TrimSuffix(key, ",local"), true
+	}
+	return key, false
+}
+
+// field returns value and description of the field with key
+func (config *Config) field(key string) (reflect.Value, reflect.StructField, bool) {
+	structType := reflect.TypeOf(*config)
+	structValue := reflect.ValueOf(config).Elem()
+
+	for i := 0; i < structType.NumField(); i++ {
+		if fieldKey, _ := configKey(structType.Field(i)); key != "" && fieldKey == key {
+			return structValue.Field(i), structType.Field(i), true
+		}
+	}
+	return reflect.Value{}, reflect.StructField{}, false
+}
+
+// set parses value into the field with key, errors name the key
+func (config *Config) set(key string, value string, source string) error {
+	fieldValue, field, exist := config.field(key)
+	if !exist {
+		return fmt.Errorf("unknown key %s", key)
+	}
+
+	err := parseConfigValue(fieldValue, field, value)
+	if err != nil {
+		return fmt.Errorf("%s: %s", key, err)
+	}
+
+	if config.sources == nil {
+		config.sources = map[string]string{}
+	}
+	config.sources[key] = source
+	return nil
+}
+
+func parseConfigValue(fieldValue reflect.Value, field reflect.StructField, value string) error {
+	// Integers are still checked against their bounds
+	if value == "" && field.Type.Kind() != reflect.Int {
+		fieldValue.Set(reflect.Zero(field.Type))
+		return nil
+	}
+
+	switch {
+	case field.Type == durationType:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q, expected e.g. 10s or 1m30s", value)
+		}
+		if duration < 0 {
+			return fmt.Errorf("negative duration %s", value)
+		}
+		fieldValue.SetInt(int64(duration))
+	case field.Type == dsnType:
+		err := DSN(value).Validate()
+		if err != nil {
+			return err
+		}
+		fieldValue.SetString(value)
+	case field.Type.Kind() == reflect.Bool:
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q, expected true or false", value)
+		}
+		fieldValue.SetBool(parsed)
+	case field.Type.Kind() == reflect.Int:
+		parsed := 0
+		if value != "" {
+			var err error
+			parsed, err = strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid integer %q", value)
+			}
+		}
+		min := 0
+		if tag := field.Tag.Get("min"); tag != "" {
+			min, _ = strconv.Atoi(tag)
+		}
+		if parsed < min {
+			return fmt.Errorf("%d is less than %d", parsed, min)
+		}
+		if tag := field.Tag.Get("max"); tag != "" {
+			if max, _ := strconv.Atoi(tag); parsed > max {
+				return fmt.Errorf("%d is greater than %d", parsed, max)
+			}
+		}
+		fieldValue.SetInt(int64(parsed))
+	default:
+		if oneof := field.Tag.Get("oneof"); oneof != "" {
+			valid := false
+			for _, option := range strings.Fields(oneof) {
+				valid = valid || option == value
+			}
+			if !valid {
+				return fmt.Errorf("invalid value %q, expected one of: %s", value, strings.Join(strings.Fields(oneof), ", "))
+			}
+		}
+		fieldValue.SetString(value)
+	}
+	return nil
+}
+
+func (config *Config) fillFromDefaults() error {
+	structType := reflect.TypeOf(*config)
+
+	for i := 0; i < structType.NumField(); i++ {
+		key, _ := configKey(structType.Field(i))
+		if key == "" {
+			continue
+		}
+		err := config.set(key, structType.Field(i).Tag.Get("default"), "default")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fillFromFile reads flat YAML (key: value) or TOML (key = value) file,
+// format is chosen by extension
+func (config *Config) fillFromFile(path string) error {
+	separator := ""
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		separator = ":"
+	case ".toml":
+		separator = "="
+	default:
+		return fmt.Errorf("Unsupported config file format: %s", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		key, value, err := parseConfigLine(scanner.Text(), separator)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, number, err)
+		}
+		if key == "" {
+			continue
+		}
+		err = config.set(key, value, path)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, number, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseConfigLine returns empty key for blank and comment lines
+func parseConfigLine(line string, separator string) (string, string, error) {
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+		return "", "", nil
+	}
+	if line[0] == ' ' || line[0] == '\t' || strings.HasPrefix(trimmed, "[") {
+		return "", "", fmt.Errorf("nested keys are not supported")
+	}
+
+	parts := strings.SplitN(trimmed, separator, 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("expected key %s value", separator)
+	}
+	key := strings.TrimSpace(parts[0])
+	value := strings.TrimSpace(parts[1])
+
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := strings.LastIndex(value, `"`)
+		if end == 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		unquoted, err := strconv.Unquote(value[:end+1])
+		if err != nil {
+			return "", "", err
+		}
+		value = unquoted
+	case strings.HasPrefix(value, "'"):
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		value = value[1:end]
+	default:
+		if comment := strings.Index(value, " #"); comment >= 0 {
+			value = strings.TrimSpace(value[:comment])
+		}
+	}
+	return key, value, nil
+}
+
+// fillFromEnv reads SILVIA_<KEY> variables, e.g. SILVIA_RING_SIZE
+func (config *Config) fillFromEnv(lookup func(string) (string, bool)) error {
+	structType := reflect.TypeOf(*config)
+
+	for i := 0; i < structType.NumField(); i++ {
+		key, _ := configKey(structType.Field(i))
+		if key == "" {
+			continue
+		}
+		name := strings.ToUpper(configPrefix + "_" + key)
+		value, exist := lookup(name)
+		if !exist {
+			continue
+		}
+		err := config.set(key, value, "env "+name)
+		if err != nil {
+			return fmt.Errorf("%s (env %s)", err, name)
+		}
+	}
+	return nil
+}
+
+func (config *Config) fillFromConsul(client *consul.Client, appName string) error {
+	pairs, _, err := client.KV().List(appName+"/", nil)
+	if err != nil {
+		return err
+	}
+	return config.fillFromPairs(pairs, appName)
+}
+
+// fillFromPairs sets keys listed under appName/ prefix. Keys missing in
+// Consul keep values of previous layers, unknown and local keys are
+// ignored.
+func (config *Config) fillFromPairs(pairs consul.KVPairs, appName string) error {
+	for _, pair := range pairs {
+		key := strings.TrimPrefix(pair.Key, appName+"/")
+		_, field, exist := config.field(key)
+		if !exist {
+			continue
+		}
+		if _, local := configKey(field); local {
+			continue
+		}
+
+		err := config.set(key, string(pair.Value), "consul "+pair.Key)
+		if err != nil {
+			return fmt.Errorf("%s (consul %s)", err, pair.Key)
+		}
+	}
+	return nil
+}
+
+// Validate checks settings depending on each other
+func (config *Config) Validate() error {
+	if config.PostgresEnabled && config.PostgresConnect == "" {
+		return errors.New("postgres_connect: required when postgres is enabled")
+	}
+	if config.RedshiftEnabled && config.RedshiftConnect == "" {
+		return errors.New("redshift_connect: required when redshift is enabled")
+	}
+	if config.RedshiftEnabled && config.RedshiftLoader == "copy" && (config.S3Endpoint == "" || config.S3Bucket == "") {
+		return errors.New("s3_endpoint, s3_bucket: required with copy redshift_loader")
+	}
+	if config.ArchiveEnabled && config.ArchiveDir == "" {
+		return errors.New("archive_dir: required when archive is enabled")
+	}
+	return nil
+}
+
+// Get returns value of the field tagged with consul key formatted as it's
+// set, empty for unknown keys
+func (config *Config) Get(key string) string {
+	fieldValue, _, exist := config.field(key)
+	if !exist {
+		return ""
+	}
+
+	switch value := fieldValue.Interface().(type) {
+	case time.Duration:
+		return value.String()
+	case DSN:
+		return string(value)
+	case bool:
+		return strconv.FormatBool(value)
+	case int:
+		return strconv.Itoa(value)
+	default:
+		return fieldValue.String()
+	}
+}
+
+// Bool returns value of the boolean key, false for unknown keys
+func (config *Config) Bool(key string) bool {
+	fieldValue, _, exist := config.field(key)
+	return exist && fieldValue.Kind() == reflect.Bool && fieldValue.Bool()
+}
+
+// Int returns value of the integer key, 0 for unknown keys
+func (config *Config) Int(key string) int {
+	fieldValue, field, exist := config.field(key)
+	if !exist || field.Type.Kind() != reflect.Int || field.Type == durationType {
+		return 0
+	}
+	return int(fieldValue.Int())
+}
+
+// Duration returns value of the duration key, 0 for unknown keys
+func (config *Config) Duration(key string) time.Duration {
+	fieldValue, field, exist := config.field(key)
+	if !exist || field.Type != durationType {
+		return 0
+	}
+	return time.Duration(fieldValue.Int())
+}
+
+// Display returns every key with its effective value and the layer it
+// was set from, secrets masked
+func (config *Config) Display() []ConfigValue {
+	structType := reflect.TypeOf(*config)
+
+	var values []ConfigValue
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		key, _ := configKey(field)
+		if key == "" {
+			continue
+		}
+
+		value := maskConfigValue(field, config.Get(key))
+		source := config.sources[key]
+		if source == "" {
+			source = "default"
+		}
+		values = append(values, ConfigValue{Key: key, Value: value, Source: source})
+	}
+	return values
+}
+
+// maskConfigValue hides secrets and passwords in connection strings
+func maskConfigValue(field reflect.StructField, value string) string {
+	switch {
+	case value == "":
+		return value
+	case field.Tag.Get("secret") == "true":
+		return "********"
+	case field.Type == dsnType:
+		return DSN(value).Redacted()
+	}
+	return value
+}
+
+// Validate checks DSN is key=value pairs or postgres:// URL
+func (dsn DSN) Validate() error {
+	value := string(dsn)
+	if strings.HasPrefix(value, "postgres://") || strings.HasPrefix(value, "postgresql://") {
+		_, err := url.Parse(value)
+		// url.Error quotes the URL, password included
+		if urlErr, ok := err.(*url.Error); ok {
+			return fmt.Errorf("invalid connection URL: %s", urlErr.Err)
+		}
+		return nil
+	}
+
+	_, err := parseDSNPairs(value)
+	return err
+}
+
+// Redacted returns DSN with password masked
+func (dsn DSN) Redacted() string {
+	value := string(dsn)
+	if strings.HasPrefix(value, "postgres://") || strings.HasPrefix(value, "postgresql://") {
+		parsed, err := url.Parse(value)
+		if err != nil {
+			return "********"
+		}
+		if _, exist := parsed.User.Password(); exist {
+			parsed.User = url.UserPassword(parsed.User.Username(), "********")
+		}
+		return parsed.String()
+	}
+
+	pairs, err := parseDSNPairs(value)
+	if err != nil {
+		return "********"
+	}
+	var parts []string
+	for _, pair := range pairs {
+		if pair[0] == "password" {
+			pair[1] = "********"
+		}
+		parts = append(parts, pair[0]+"="+quoteDSNValue(pair[1]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseDSNPairs splits key=value connection string, values may be single
+// quoted with backslash escapes as in libpq
+func parseDSNPairs(value string) ([][2]string, error) {
+	var pairs [][2]string
+	runes := []rune(value)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(runes) && runes[i] != '=' && !unicode.IsSpace(runes[i]) {
+			i++
+		}
+		key := string(runes[start:i])
+		for i < len(runes) && unicode.IsSpace(runes[i]) {
+			i++
+		}
+		if i == len(runes) || runes[i] != '=' {
+			return nil, fmt.Errorf("invalid connection string: missing \"=\" after %q", key)
+		}
+		if key == "" {
+			return nil, errors.New("invalid connection string: missing key before \"=\"")
+		}
+		i++
+		for i < len(runes) && unicode.IsSpace(runes[i]) {
+			i++
+		}
+
+		var pairValue []rune
+		if i < len(runes) && runes[i] == '\'' {
+			i++
+			closed := false
+			for i < len(runes) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					pairValue = append(pairValue, runes[i+1])
+					i += 2
+					continue
+				}
+				if runes[i] == '\'' {
+					closed = true
+					i++
+					break
+				}
+				pairValue = append(pairValue, runes[i])
+				i++
+			}
+			if !closed {
+				return nil, fmt.Errorf("invalid connection string: unterminated quoted value of %s", key)
+			}
+		} else {
+			for i < len(runes) && !unicode.IsSpace(runes[i]) {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				pairValue = append(pairValue, runes[i])
+				i++
+			}
+		}
+		pairs = append(pairs, [2]string{key, string(pairValue)})
+	}
+	return pairs, nil
+}
+
+func quoteDSNValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t'\\") {
+		return value
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + "'"
+}
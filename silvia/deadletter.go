@@ -0,0 +1,110 @@
+package silvia
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Pipeline stages reported in StageError
+const (
+	StageTransform = "transform"
+	StageWrite     = "write"
+)
+
+type (
+	// StageError is a failure of pipeline stage reported to Delivery.Done.
+	// Messages failed with it are dead-lettered if it's configured.
+	StageError struct {
+		Stage string
+		Type  string
+		Err   error
+	}
+
+	deadLetterer interface {
+		Publish(delivery *Delivery, failure *StageError) error
+	}
+
+	// DeadLetters publishes raw payloads of failed messages to the
+	// dead-letter exchange and waits for broker confirmation.
+	DeadLetters struct {
+		sync.Mutex
+		Exchange string
+		channel  *amqp.Channel
+		confirms chan amqp.Confirmation
+	}
+)
+
+func (err *StageError) Error() string {
+	return err.Err.Error()
+}
+
+// NewDeadLetters declares topic exchange with a durable queue of the same
+// name bound to it, so dead letters are kept until someone inspects them.
+func NewDeadLetters(connection *amqp.Connection, exchange string) (*DeadLetters, error) {
+	channel, err := connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = channel.ExchangeDeclare(exchange, "topic", true, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = channel.QueueDeclare(exchange, true, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = channel.QueueBind(exchange, "#", exchange, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = channel.Confirm(false)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeadLetters{
+		Exchange: exchange,
+		channel:  channel,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+	}, nil
+}
+
+// Publish sends message body routed by its tracker name with failure
+// details in headers
+func (deadLetters *DeadLetters) Publish(delivery *Delivery, failure *StageError) error {
+	deadLetters.Lock()
+	defer deadLetters.Unlock()
+
+	err := deadLetters.channel.Publish(deadLetters.Exchange, delivery.Tracker, false, false, amqp.Publishing{
+		Headers:      deadLetterHeaders(delivery, failure),
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now().UTC(),
+		Body:         delivery.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	confirmation, ok := <-deadLetters.confirms
+	if !ok {
+		return errors.New("Dead-letter channel closed")
+	}
+	if !confirmation.Ack {
+		return errors.New("Dead letter rejected by RabbitMQ")
+	}
+	return nil
+}
+
+func deadLetterHeaders(delivery *Delivery, failure *StageError) amqp.Table {
+	return amqp.Table{
+		"error_type": failure.Type,
+		"error":      failure.Error(),
+		"stage":      failure.Stage,
+		"tracker":    delivery.Tracker,
+	}
+}
@@ -0,0 +1,88 @@
+package silvia
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// Dedup drops events whose key was already seen within the window.
+	// Keys of events requeued to RabbitMQ are forgotten, so their
+	// redelivery is not taken for a duplicate.
+	Dedup struct {
+		sync.Mutex
+		Window time.Duration
+
+		seen    map[string]time.Time
+		order   []dedupKey
+		dropped int
+		now     func() time.Time
+	}
+
+	dedupKey struct {
+		Key  string
+		Seen time.Time
+	}
+
+	DedupStatus struct {
+		Keys    int
+		Dropped int
+	}
+)
+
+func NewDedup(window time.Duration) *Dedup {
+	return &Dedup{Window: window, seen: map[string]time.Time{}, now: time.Now}
+}
+
+// Seen reports whether key was seen within the window and remembers it
+// otherwise. Empty keys are never duplicates.
+func (dedup *Dedup) Seen(key string) bool {
+	if dedup == nil || key == "" {
+		return false
+	}
+
+	dedup.Lock()
+	defer dedup.Unlock()
+
+	now := dedup.now()
+	dedup.expire(now)
+	if _, exist := dedup.seen[key]; exist {
+		dedup.dropped++
+		return true
+	}
+	dedup.seen[key] = now
+	dedup.order = append(dedup.order, dedupKey{Key: key, Seen: now})
+	return false
+}
+
+// Forget removes key, so the next event with it passes
+func (dedup *Dedup) Forget(key string) {
+	if dedup == nil || key == "" {
+		return
+	}
+	dedup.Lock()
+	delete(dedup.seen, key)
+	dedup.Unlock()
+}
+
+// expire removes keys seen before the window, keys seen again after being
+// forgotten stay until their latest time expires
+func (dedup *Dedup) expire(now time.Time) {
+	i := 0
+	for ; i < len(dedup.order) && now.Sub(dedup.order[i].Seen) >= dedup.Window; i++ {
+		key := dedup.order[i]
+		if seen, exist := dedup.seen[key.Key]; exist && seen.Equal(key.Seen) {
+			delete(dedup.seen, key.Key)
+		}
+	}
+	dedup.order = dedup.order[i:]
+}
+
+func (dedup *Dedup) Status() DedupStatus {
+	if dedup == nil {
+		return DedupStatus{}
+	}
+	dedup.Lock()
+	defer dedup.Unlock()
+	return DedupStatus{Keys: len(dedup.seen), Dropped: dedup.dropped}
+}
@@ -0,0 +1,66 @@
+package silvia
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedup(t *testing.T) {
+	now := time.Date(2016, 4, 15, 17, 46, 55, 0, time.UTC)
+	dedup := NewDedup(time.Minute)
+	dedup.now = func() time.Time { return now }
+
+	steps := []struct {
+		title   string
+		advance time.Duration
+		key     string
+		seen    bool
+	}{
+		{`First event`, 0, "a", false},
+		{`Duplicate within window`, 30 * time.Second, "a", true},
+		{`Other event`, 0, "b", false},
+		{`Empty key is never duplicate`, 0, "", false},
+		{`Empty key again`, 0, "", false},
+		{`Duplicate expired`, 30 * time.Second, "a", false},
+		{`Key seen again is kept`, 0, "a", true},
+		{`Other event within window`, 20 * time.Second, "b", true},
+		{`Other event expired`, 10 * time.Second, "b", false},
+	}
+	for _, step := range steps {
+		now = now.Add(step.advance)
+		if seen := dedup.Seen(step.key); seen != step.seen {
+			t.Errorf("Failed on: %s\nSeen: %v", step.title, seen)
+		}
+	}
+
+	status := dedup.Status()
+	if status.Keys != 2 || status.Dropped != 3 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+
+	dedup.Forget("a")
+	if dedup.Seen("a") {
+		t.Errorf("Forgotten key must not be duplicate")
+	}
+	// Forgotten key is kept until its latest time expires
+	now = now.Add(50 * time.Second)
+	if !dedup.Seen("a") {
+		t.Errorf("Key seen after forget must be kept")
+	}
+}
+
+func TestDedupKey(t *testing.T) {
+	event := &AdjustEvent{}
+	err := event.Transform([]byte(transformResults[0].request))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := event.DedupKey(); key == "" {
+		t.Errorf("Adjust event must have key")
+	}
+
+	event.Ct = NullTime{}
+	if key := event.DedupKey(); key != "" {
+		t.Errorf("Event without creation time must not have key, got %q", key)
+	}
+}
@@ -0,0 +1,234 @@
+package silvia
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// MetricVec is a counter or gauge partitioned by label values
+	MetricVec struct {
+		sync.Mutex
+		Name   string
+		Help   string
+		Type   string
+		Labels []string
+		values map[string]float64
+	}
+
+	// HistogramVec counts observations into cumulative buckets
+	// partitioned by label values
+	HistogramVec struct {
+		sync.Mutex
+		Name    string
+		Help    string
+		Labels  []string
+		Buckets []float64
+		values  map[string]*histogram
+	}
+
+	histogram struct {
+		counts []uint64
+		count  uint64
+		sum    float64
+	}
+
+	// Metrics of the pipeline exposed at /metrics
+	Metrics struct {
+		Consumed        *MetricVec
+		Transformed     *MetricVec
+		TransformFailed *MetricVec
+		Written         *MetricVec
+		WriteFailed     *MetricVec
+		DeadLettered    *MetricVec
+		SinkReconnects  *MetricVec
+		Spilled         *MetricVec
+		Duplicates      *MetricVec
+		TransformPanics *MetricVec
+		SkippedContexts *MetricVec
+
+		TransformLatency *HistogramVec
+		WriteLatency     *HistogramVec
+	}
+)
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Consumed:        NewCounterVec("silvia_events_consumed_total", "Messages consumed from RabbitMQ.", "tracker"),
+		Transformed:     NewCounterVec("silvia_events_transformed_total", "Events transformed successfully.", "tracker"),
+		TransformFailed: NewCounterVec("silvia_events_transform_failed_total", "Events failed to transform.", "tracker"),
+		Written:         NewCounterVec("silvia_events_written_total", "Events written to sink.", "sink", "tracker"),
+		WriteFailed:     NewCounterVec("silvia_events_write_failed_total", "Events failed to be written to sink.", "sink", "tracker"),
+		DeadLettered:    NewCounterVec("silvia_events_dead_lettered_total", "Messages published to dead-letter exchange.", "tracker", "stage"),
+		SinkReconnects:  NewCounterVec("silvia_sink_reconnects_total", "Times connection to sink was lost.", "sink"),
+		Spilled:         NewCounterVec("silvia_events_spilled_total", "Events kept on disk while sink is down.", "sink", "tracker"),
+		Duplicates:      NewCounterVec("silvia_events_duplicate_total", "Duplicate events dropped before writing.", "tracker"),
+		TransformPanics: NewCounterVec("silvia_transform_panics_total", "Events failed to transform with panic.", "tracker"),
+		SkippedContexts: NewCounterVec("silvia_contexts_skipped_total", "Snowplow contexts skipped as they aren't JSON objects."),
+
+		TransformLatency: NewHistogramVec("silvia_transform_duration_seconds", "Time spent transforming an event.",
+			[]float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1}, "tracker"),
+		WriteLatency: NewHistogramVec("silvia_batch_write_duration_seconds", "Time spent writing a batch to sink.",
+			[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}, "sink", "tracker"),
+	}
+}
+
+func NewCounterVec(name string, help string, labels ...string) *MetricVec {
+	return &MetricVec{Name: name, Help: help, Type: "counter", Labels: labels, values: map[string]float64{}}
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *MetricVec {
+	return &MetricVec{Name: name, Help: help, Type: "gauge", Labels: labels, values: map[string]float64{}}
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{Name: name, Help: help, Buckets: buckets, Labels: labels, values: map[string]*histogram{}}
+}
+
+// Expose writes all metrics in Prometheus text format
+func (metrics *Metrics) Expose(w io.Writer) {
+	metrics.Consumed.Expose(w)
+	metrics.Transformed.Expose(w)
+	metrics.TransformFailed.Expose(w)
+	metrics.Written.Expose(w)
+	metrics.WriteFailed.Expose(w)
+	metrics.DeadLettered.Expose(w)
+	metrics.SinkReconnects.Expose(w)
+	metrics.Spilled.Expose(w)
+	metrics.Duplicates.Expose(w)
+	metrics.TransformPanics.Expose(w)
+	metrics.SkippedContexts.Expose(w)
+	metrics.TransformLatency.Expose(w)
+	metrics.WriteLatency.Expose(w)
+}
+
+func (vec *MetricVec) Add(value float64, labelValues ...string) {
+	key := labelKey(vec.Labels, labelValues)
+	vec.Lock()
+	vec.values[key] += value
+	vec.Unlock()
+}
+
+func (vec *MetricVec) Inc(labelValues ...string) {
+	vec.Add(1, labelValues...)
+}
+
+func (vec *MetricVec) Set(value float64, labelValues ...string) {
+	key := labelKey(vec.Labels, labelValues)
+	vec.Lock()
+	vec.values[key] = value
+	vec.Unlock()
+}
+
+func (vec *MetricVec) Get(labelValues ...string) float64 {
+	key := labelKey(vec.Labels, labelValues)
+	vec.Lock()
+	defer vec.Unlock()
+	return vec.values[key]
+}
+
+func (vec *MetricVec) Expose(w io.Writer) {
+	vec.Lock()
+	defer vec.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", vec.Name, vec.Help, vec.Name, vec.Type)
+	for _, key := range sortedKeys(vec.values) {
+		fmt.Fprintf(w, "%s%s %s\n", vec.Name, key, formatFloat(vec.values[key]))
+	}
+}
+
+func (vec *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := labelKey(vec.Labels, labelValues)
+	vec.Lock()
+	defer vec.Unlock()
+
+	h, exist := vec.values[key]
+	if !exist {
+		h = &histogram{counts: make([]uint64, len(vec.Buckets))}
+		vec.values[key] = h
+	}
+	for i, bound := range vec.Buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// Since observes seconds elapsed from start
+func (vec *HistogramVec) Since(start time.Time, labelValues ...string) {
+	vec.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (vec *HistogramVec) Expose(w io.Writer) {
+	vec.Lock()
+	defer vec.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", vec.Name, vec.Help, vec.Name)
+	keys := make([]string, 0, len(vec.values))
+	for key := range vec.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		h := vec.values[key]
+		for i, bound := range vec.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", vec.Name, withLabel(key, "le", formatFloat(bound)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", vec.Name, withLabel(key, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", vec.Name, key, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", vec.Name, key, h.count)
+	}
+}
+
+// labelKey renders label pairs as they are written after metric name
+func labelKey(labels []string, values []string) string {
+	if len(labels) != len(values) {
+		panic(fmt.Sprintf("Expected %d label values, got %d", len(labels), len(values)))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(labels))
+	for i, label := range labels {
+		pairs[i] = label + `="` + escapeLabel(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func withLabel(key string, label string, value string) string {
+	pair := label + `="` + escapeLabel(value) + `"`
+	if key == "" {
+		return "{" + pair + "}"
+	}
+	return key[:len(key)-1] + "," + pair + "}"
+}
+
+func escapeLabel(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, "\n", `\n`, -1)
+	return strings.Replace(value, `"`, `\"`, -1)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,80 @@
+package silvia
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricVecExpose(t *testing.T) {
+	written := NewCounterVec("silvia_events_written_total", "Events written to sink.", "sink", "tracker")
+	written.Add(30, "redshift", "adjust")
+	written.Inc("postgres", "snow\"plow")
+	written.Inc("postgres", "snow\"plow")
+
+	var b bytes.Buffer
+	written.Expose(&b)
+
+	expected := `# HELP silvia_events_written_total Events written to sink.
+# TYPE silvia_events_written_total counter
+silvia_events_written_total{sink="postgres",tracker="snow\"plow"} 2
+silvia_events_written_total{sink="redshift",tracker="adjust"} 30
+`
+	if b.String() != expected {
+		t.Errorf("Unexpected exposition:\n%s", b.String())
+	}
+}
+
+func TestHistogramVecExpose(t *testing.T) {
+	latency := NewHistogramVec("silvia_transform_duration_seconds", "Time spent transforming an event.", []float64{.1, 1}, "tracker")
+	latency.Observe(.05, "adjust")
+	latency.Observe(.5, "adjust")
+	latency.Observe(5, "adjust")
+
+	var b bytes.Buffer
+	latency.Expose(&b)
+
+	for _, line := range []string{
+		`# TYPE silvia_transform_duration_seconds histogram`,
+		`silvia_transform_duration_seconds_bucket{tracker="adjust",le="0.1"} 1`,
+		`silvia_transform_duration_seconds_bucket{tracker="adjust",le="1"} 2`,
+		`silvia_transform_duration_seconds_bucket{tracker="adjust",le="+Inf"} 3`,
+		`silvia_transform_duration_seconds_sum{tracker="adjust"} 5.55`,
+		`silvia_transform_duration_seconds_count{tracker="adjust"} 3`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("Exposition doesn't contain %q:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestMetricsApi(t *testing.T) {
+	sink := newTestSinkState(&testSink{}, 5)
+	sink.Health.Set(true)
+	sink.Buses["snowplow"].Events <- &SnowplowEvent{}
+
+	tracker := &TrackerState{Tracker: &SnowplowTracker{}, RequestBus: make(chan *Delivery)}
+	worker := &Worker{Stats: &Stats{}, Trackers: []*TrackerState{tracker}, Sinks: []*SinkState{sink}}
+
+	recorder := httptest.NewRecorder()
+	MetricsApi(recorder, httptest.NewRequest("GET", "/metrics", nil), worker)
+
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`# TYPE silvia_events_consumed_total counter`,
+		`# TYPE silvia_batch_write_duration_seconds histogram`,
+		`silvia_request_bus_depth{tracker="snowplow"} 0`,
+		`silvia_sink_bus_depth{sink="test",tracker="snowplow"} 1`,
+		`silvia_sink_bus_depth{sink="test",tracker="adjust"} 0`,
+		`silvia_rabbit_up 0`,
+		`silvia_sink_up{sink="test"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("Metrics don't contain %q", line)
+		}
+	}
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected content type: %s", recorder.Header().Get("Content-Type"))
+	}
+}
@@ -2,7 +2,10 @@ package silvia
 
 import (
 	"database/sql"
+	"reflect"
 	"strconv"
+	"sync"
+	"time"
 
 	_ "github.com/lib/pq"
 	"gopkg.in/gorp.v1"
@@ -10,61 +13,229 @@ import (
 
 type Postgres struct {
 	Connection *gorp.DbMap
+	tables     sync.Mutex
+	shreds     shredTables
+}
+
+func init() {
+	RegisterSink("postgres", SinkDriver{
+		New:   func() Sink { return &Postgres{} },
+		Batch: BatchLimits{MaxRows: 1, MaxBytes: 1 << 20, MaxAge: time.Second},
+	})
+	RegisterSink("redshift", SinkDriver{
+		New:   func() Sink { return &Redshift{} },
+		Batch: defaultSnowplowBatch,
+		Batches: map[string]BatchLimits{
+			"adjust":   defaultAdjustBatch,
+			"snowplow": defaultSnowplowBatch,
+		},
+	})
 }
 
 type Redshift struct {
-	Connection   *gorp.DbMap
-	snowplowTmap *gorp.TableMap
-	adjustTmap   *gorp.TableMap
+	Connection *gorp.DbMap
+	Stage      *RedshiftStage
+	tables     sync.Mutex
+	shreds     shredTables
 }
 
 func (redshift *Redshift) Connect(config *Config) error {
 
-	db, err := sql.Open("postgres", config.RedshiftConnect)
+	db, err := sql.Open("postgres", string(config.RedshiftConnect))
+	if err != nil {
+		return err
+	}
+	// sql.Open doesn't connect
+	err = db.Ping()
 	if err != nil {
+		db.Close()
 		return err
 	}
 
-	// snowplowTmap.Columns.Columnname
-	// db.Prepare(pq.CopyInSchema("snowplow", "events", GetColumns(snowplowTmap)...))
+	// Batches are loaded with multi-row INSERT unless COPY is enabled
+	if config.RedshiftLoader == "copy" {
+		redshift.Stage, err = NewRedshiftStage(config)
+		if err != nil {
+			db.Close()
+			return err
+		}
+	}
 
-	// stmt, err := db.Prepare(pq.CopyIn("users", "name", "age"))
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
+	redshift.Connection = &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
+	redshift.shreds.reset()
+	return nil
+}
+
+// Write loads events and their shreds in a single transaction, shredded
+// tables are created on first use
+func (redshift *Redshift) Write(table Table, events []Event) error {
+	redshift.tables.Lock()
+	tmap := tableFor(redshift.Connection, table, events[0], false)
+	redshift.tables.Unlock()
 
-	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
+	values := make([]interface{}, len(events))
+	for i, event := range events {
+		values[i] = event
+	}
+
+	shreds := shredEvents(events)
+	if len(shreds) == 0 {
+		return redshift.Load(redshift.Connection, table.Schema, table.Name, GetColumns(tmap), values)
+	}
+
+	err := redshift.shreds.migrate(redshift.Connection, table.Schema, shreds, true)
+	if err != nil {
+		return err
+	}
+
+	transaction, err := redshift.Connection.Begin()
+	if err != nil {
+		return err
+	}
+	err = redshift.Load(transaction, table.Schema, table.Name, GetColumns(tmap), values)
+	if err == nil {
+		err = writeShreds(transaction, table.Schema, shreds, redshift.Load)
+	}
+	if err != nil {
+		transaction.Rollback()
+		return err
+	}
+	return transaction.Commit()
+}
+
+func (redshift *Redshift) Ping() error {
+	return redshift.Connection.Db.Ping()
+}
+
+func (redshift *Redshift) Close() error {
+	return redshift.Connection.Db.Close()
+}
+
+// Insert writes events to schema.table with multi-row INSERTs
+func (redshift *Redshift) Insert(db execer, schema string, table string, columns []string, events []interface{}) error {
+	return insertRows(db, schema, table, columns, events)
+}
+
+// Load writes events to schema.table through S3 staging when it's
+// configured, with Insert otherwise
+func (redshift *Redshift) Load(db execer, schema string, table string, columns []string, events []interface{}) error {
+	if redshift.Stage != nil {
+		return redshift.Stage.Copy(db, schema, table, columns, events)
+	}
+	return redshift.Insert(db, schema, table, columns, events)
+}
 
-	// snowplowTmap := dbmap.AddTableWithNameAndSchema(SnowplowEvent{}, "atomic", "events")
-	// adjustTmap := dbmap.AddTableWithNameAndSchema(AdjustEvent{}, "adjust", "events")
+// Maximum number of bind parameters of a PostgreSQL statement
+const maxBindParams = 65535
 
-	redshift.Connection = dbmap
+// insertRows writes events or rows to schema.table with multi-row INSERTs
+// of as many rows as bind parameters allow, db must be a transaction for
+// them to be written at once
+func insertRows(db execer, schema string, table string, columns []string, events []interface{}) error {
+	rows := maxBindParams / len(columns)
+	for len(events) > 0 {
+		chunk := events
+		if len(chunk) > rows {
+			chunk = chunk[:rows]
+		}
+		query, args := batchInsert(schema, table, columns, chunk)
+		_, err := db.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+		events = events[len(chunk):]
+	}
 	return nil
 }
 
-// GetColumns fetches column names from gorp tablemap
+// tableFor returns tablemap of event type, mapping it to table on first
+// use. Types with Id field get it as autoincrement key if keys is set.
+func tableFor(dbmap *gorp.DbMap, table Table, event Event, keys bool) *gorp.TableMap {
+	eventType := reflect.Indirect(reflect.ValueOf(event)).Type()
+	tmap, err := dbmap.TableFor(eventType, false)
+	if err == nil {
+		return tmap
+	}
+
+	tmap = dbmap.AddTableWithNameAndSchema(reflect.Zero(eventType).Interface(), table.Schema, table.Name)
+	if _, exist := eventType.FieldByName("Id"); exist && keys {
+		tmap.SetKeys(true, "Id")
+	}
+	return tmap
+}
+
+// GetColumns fetches non-transient column names from gorp tablemap
 func GetColumns(tmap *gorp.TableMap) (columns []string) {
 
 	for index, _ := range tmap.Columns {
+		if tmap.Columns[index].Transient {
+			continue
+		}
 		columns = append(columns, tmap.Columns[index].ColumnName)
 	}
 	return columns
 }
 
 func (postgres *Postgres) Connect(config *Config) error {
-	db, err := sql.Open("postgres", config.PostgresConnect)
+	db, err := sql.Open("postgres", string(config.PostgresConnect))
 	if err != nil {
 		return err
 	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return err
+	}
 
-	dbmap := &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
-	dbmap.AddTableWithNameAndSchema(SnowplowEvent{}, "atomic", "events").SetKeys(true, "Id")
-	dbmap.AddTableWithNameAndSchema(AdjustEvent{}, "adjust", "events").SetKeys(true, "Id")
-
-	postgres.Connection = dbmap
+	postgres.Connection = &gorp.DbMap{Db: db, Dialect: gorp.PostgresDialect{}}
+	postgres.shreds.reset()
 	return nil
 }
 
+func (postgres *Postgres) Write(table Table, events []Event) error {
+	postgres.tables.Lock()
+	tableFor(postgres.Connection, table, events[0], true)
+	postgres.tables.Unlock()
+
+	values := make([]interface{}, len(events))
+	for i, event := range events {
+		values[i] = event
+	}
+	return postgres.insert(table.Schema, values, shredEvents(events))
+}
+
+// insert writes events with their shreds in a single transaction
+func (postgres *Postgres) insert(schema string, events []interface{}, shreds []*shredBatch) error {
+	err := postgres.shreds.migrate(postgres.Connection, schema, shreds, false)
+	if err != nil {
+		return err
+	}
+
+	transaction, err := postgres.Connection.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = transaction.Insert(events...)
+	if err == nil {
+		err = writeShreds(transaction, schema, shreds, insertRows)
+	}
+	if err != nil {
+		transaction.Rollback()
+		return err
+	}
+
+	return transaction.Commit()
+}
+
+func (postgres *Postgres) Ping() error {
+	return postgres.Connection.Db.Ping()
+}
+
+func (postgres *Postgres) Close() error {
+	return postgres.Connection.Db.Close()
+}
+
 func checkStringForNull(eventStr string, event *sql.NullString) {
 	if len(eventStr) == 0 {
 		event.Valid = false
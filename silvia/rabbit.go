@@ -1,15 +1,53 @@
 package silvia
 
 import (
+	"context"
+	"errors"
+	"log"
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 )
 
+// Maximum number of unacknowledged messages per consumer. Must stay above
+// the largest Redshift batch plus the event bus buffers, otherwise batches
+// never fill up, *_batch_rows config keys are limited to half of it.
+const rabbitPrefetch = 500
+
 type Rabbit struct {
 	Connection   *amqp.Connection
 	Channel      *amqp.Channel
 	ConsFailChan chan bool
+	DeadLetters  *DeadLetters
+}
+
+// Delivery is a consumed RabbitMQ message. It is acknowledged only after
+// every writer which received the event built from it reported success,
+// and rejected with requeue if any of them failed. With dead-lettering
+// enabled messages failed to transform, or failed to write again after
+// redelivery, are published to the dead-letter exchange instead.
+type Delivery struct {
+	sync.Mutex
+	Body         []byte
+	Tag          uint64
+	Tracker      string
+	Received     time.Time
+	Redelivered  bool
+	acknowledger amqp.Acknowledger
+	deadLetters  deadLetterer
+	pending      int
+	failed       bool
+	failure      *StageError
+	// Called once the message is requeued
+	onRequeue func()
+	// Indexes of events of the message dropped as duplicates
+	dropped []int
+	// Set once the message is written to archive, a message of several
+	// events is archived once
+	archived bool
 }
 
 func (rabbit *Rabbit) Connect(config *Config) error {
@@ -18,7 +56,7 @@ func (rabbit *Rabbit) Connect(config *Config) error {
 		return err
 	}
 
-	addr := addrs[0].String() + ":" + config.RabbitPort
+	addr := addrs[0].String() + ":" + strconv.Itoa(config.RabbitPort)
 
 	rabbit.Connection, err = amqp.Dial("amqp://guest:guest@" + addr + "/")
 	if err != nil {
@@ -28,7 +66,10 @@ func (rabbit *Rabbit) Connect(config *Config) error {
 	return nil
 }
 
-func (rabbit *Rabbit) Consume(queueName string, bus chan []byte) error {
+// Consume pushes messages from queueName to bus until the channel fails or
+// ctx is cancelled. Messages left unread after cancellation stay unacked
+// and are redelivered by RabbitMQ.
+func (rabbit *Rabbit) Consume(ctx context.Context, queueName string, bus chan *Delivery) error {
 	defer func() {
 		rabbit.ConsFailChan <- true
 	}()
@@ -38,19 +79,105 @@ func (rabbit *Rabbit) Consume(queueName string, bus chan []byte) error {
 		return err
 	}
 
-	msgs, err := rabbit.Channel.Consume(q.Name, "", false, false, false, false, nil)
+	msgs, err := rabbit.Channel.Consume(q.Name, queueName, false, false, false, false, nil)
 	if err != nil {
 		return err
 	}
 
-	for d := range msgs {
-		err := d.Ack(false)
-		if err != nil {
-			return err
+	for {
+		select {
+		case <-ctx.Done():
+			return rabbit.Channel.Cancel(queueName, false)
+		case d, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+
+			delivery := &Delivery{
+				Body:         d.Body,
+				Tag:          d.DeliveryTag,
+				Received:     time.Now().UTC(),
+				Redelivered:  d.Redelivered,
+				acknowledger: d.Acknowledger,
+			}
+			if rabbit.DeadLetters != nil {
+				delivery.deadLetters = rabbit.DeadLetters
+			}
+
+			select {
+			case bus <- delivery:
+			case <-ctx.Done():
+				return rabbit.Channel.Cancel(queueName, false)
+			}
 		}
+	}
+}
 
-		bus <- d.Body
+// Add registers n more writers the delivery has to wait for.
+func (delivery *Delivery) Add(n int) {
+	if delivery == nil {
+		return
 	}
+	delivery.Lock()
+	delivery.pending += n
+	delivery.Unlock()
+}
 
-	return nil
+// Done reports the result of one writer. The message is acked or nacked
+// once the last pending writer is done. Safe to call on nil, which is the
+// case for events not built from a RabbitMQ message.
+func (delivery *Delivery) Done(err error) {
+	if delivery == nil {
+		return
+	}
+
+	delivery.Lock()
+	defer delivery.Unlock()
+
+	delivery.pending--
+	if err != nil {
+		delivery.failed = true
+		var failure *StageError
+		if delivery.failure == nil && errors.As(err, &failure) {
+			delivery.failure = failure
+		}
+	}
+	if delivery.pending > 0 {
+		return
+	}
+
+	switch {
+	case !delivery.failed:
+		err = delivery.acknowledger.Ack(delivery.Tag, false)
+	case delivery.deadLettered():
+		metrics.DeadLettered.Inc(delivery.Tracker, delivery.failure.Stage)
+		err = delivery.acknowledger.Ack(delivery.Tag, false)
+	default:
+		err = delivery.acknowledger.Nack(delivery.Tag, false, true)
+		if delivery.onRequeue != nil {
+			delivery.onRequeue()
+		}
+	}
+	if err != nil {
+		log.Println("Can't acknowledge RabbitMQ message:", err)
+	}
+}
+
+// deadLettered publishes failed message to the dead-letter exchange if
+// it's enabled and the failure is not worth retrying. Write failures are
+// retried once, as they are usually caused by an unavailable sink.
+func (delivery *Delivery) deadLettered() bool {
+	if delivery.deadLetters == nil || delivery.failure == nil {
+		return false
+	}
+	if delivery.failure.Stage == StageWrite && !delivery.Redelivered {
+		return false
+	}
+
+	err := delivery.deadLetters.Publish(delivery, delivery.failure)
+	if err != nil {
+		log.Println("Can't publish dead letter:", err)
+		return false
+	}
+	return true
 }
@@ -0,0 +1,132 @@
+package silvia
+
+import (
+	"errors"
+	"testing"
+)
+
+type testAcknowledger struct {
+	acks    []uint64
+	nacks   []uint64
+	requeue bool
+}
+
+func (ack *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	ack.acks = append(ack.acks, tag)
+	return nil
+}
+
+func (ack *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	ack.nacks = append(ack.nacks, tag)
+	ack.requeue = requeue
+	return nil
+}
+
+func (ack *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	return ack.Nack(tag, false, requeue)
+}
+
+var deliveryResults = []struct {
+	title   string
+	results []error
+	acked   bool
+	nacked  bool
+}{
+	{`Single writer success`, []error{nil}, true, false},
+	{`Single writer failure`, []error{errors.New("insert failed")}, false, true},
+	{`Both writers success`, []error{nil, nil}, true, false},
+	{`One of writers failed`, []error{nil, errors.New("batch failed")}, false, true},
+}
+
+func TestDeliveryDone(t *testing.T) {
+	for _, testCase := range deliveryResults {
+		ack := &testAcknowledger{}
+		delivery := &Delivery{Tag: 42, acknowledger: ack}
+		delivery.Add(len(testCase.results))
+
+		for i, err := range testCase.results {
+			if len(ack.acks)+len(ack.nacks) > 0 {
+				t.Errorf("Failed on: %s\nAcknowledged before writer %d reported", testCase.title, i)
+			}
+			delivery.Done(err)
+		}
+
+		if acked := len(ack.acks) == 1; acked != testCase.acked {
+			t.Errorf("Failed on: %s\nAcked: %v, expected: %v", testCase.title, acked, testCase.acked)
+		}
+		if nacked := len(ack.nacks) == 1; nacked != testCase.nacked {
+			t.Errorf("Failed on: %s\nNacked: %v, expected: %v", testCase.title, nacked, testCase.nacked)
+		}
+		if testCase.nacked && !ack.requeue {
+			t.Errorf("Failed on: %s\nFailed delivery must be requeued", testCase.title)
+		}
+	}
+}
+
+func TestNilDeliveryDone(t *testing.T) {
+	var delivery *Delivery
+	delivery.Add(1)
+	delivery.Done(nil)
+}
+
+type testDeadLetters struct {
+	published []*StageError
+	err       error
+}
+
+func (deadLetters *testDeadLetters) Publish(delivery *Delivery, failure *StageError) error {
+	if deadLetters.err != nil {
+		return deadLetters.err
+	}
+	deadLetters.published = append(deadLetters.published, failure)
+	return nil
+}
+
+var transformFailure = &StageError{Stage: StageTransform, Type: "Transform", Err: errors.New("invalid character")}
+var writeFailure = &StageError{Stage: StageWrite, Type: "Write", Err: errors.New("redshift: connection reset")}
+
+var deadLetterResults = []struct {
+	title        string
+	err          error
+	redelivered  bool
+	publishErr   error
+	deadLettered bool
+	requeued     bool
+}{
+	{`Transform failure`, transformFailure, false, nil, true, false},
+	{`First write failure is retried`, writeFailure, false, nil, false, true},
+	{`Write failure after redelivery`, writeFailure, true, nil, true, false},
+	{`No writers is retried`, errNoWriters, true, nil, false, true},
+	{`Dead letter not published`, transformFailure, false, errors.New("channel closed"), false, true},
+}
+
+func TestDeliveryDeadLetter(t *testing.T) {
+	for _, testCase := range deadLetterResults {
+		ack := &testAcknowledger{}
+		deadLetters := &testDeadLetters{err: testCase.publishErr}
+		delivery := &Delivery{Tag: 42, Tracker: "snowplow", Redelivered: testCase.redelivered, acknowledger: ack, deadLetters: deadLetters}
+		delivery.Add(1)
+		delivery.Done(testCase.err)
+
+		if deadLettered := len(deadLetters.published) == 1; deadLettered != testCase.deadLettered {
+			t.Errorf("Failed on: %s\nDead-lettered: %v, expected: %v", testCase.title, deadLettered, testCase.deadLettered)
+		}
+		if testCase.deadLettered && (len(ack.acks) != 1 || deadLetters.published[0] != testCase.err) {
+			t.Errorf("Failed on: %s\nDead-lettered message must be acked with its failure", testCase.title)
+		}
+		if requeued := len(ack.nacks) == 1 && ack.requeue; requeued != testCase.requeued {
+			t.Errorf("Failed on: %s\nRequeued: %v, expected: %v", testCase.title, requeued, testCase.requeued)
+		}
+	}
+}
+
+func TestDeadLetterHeaders(t *testing.T) {
+	delivery := &Delivery{Tracker: "adjust"}
+	headers := deadLetterHeaders(delivery, transformFailure)
+	if headers["error_type"] != "Transform" || headers["error"] != "invalid character" || headers["stage"] != "transform" || headers["tracker"] != "adjust" {
+		t.Errorf("Unexpected headers: %v", headers)
+	}
+	if err := headers.Validate(); err != nil {
+		t.Errorf("Invalid headers: %s", err)
+	}
+}
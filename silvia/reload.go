@@ -0,0 +1,245 @@
+package silvia
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	// Count of last config changes shown in /v1/status
+	configChangesSize = 20
+	// How long a Consul blocking query waits for KV changes
+	configWatchWait = 5 * time.Minute
+)
+
+var errShuttingDown = errors.New("Worker is shutting down")
+
+// ConfigChange is a change of a key seen in Consul. Rejected changes are
+// kept in ring with the reason as error, the key keeps its value.
+type ConfigChange struct {
+	Time    time.Time
+	Key     string `json:",omitempty"`
+	From    string `json:",omitempty"`
+	To      string `json:",omitempty"`
+	Applied bool
+}
+
+// WatchConfig follows silvia/ Consul KV prefix with blocking queries
+// until shutdown and applies changed keys to the running worker
+func (worker *Worker) WatchConfig() {
+	if worker.consul == nil {
+		return
+	}
+
+	kv := worker.consul.KV()
+	var index uint64
+	for {
+		options := &consul.QueryOptions{WaitIndex: index, WaitTime: configWatchWait}
+		pairs, meta, err := kv.List(configPrefix+"/", options.WithContext(worker.ctx))
+		if worker.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Println("Can't watch config in Consul! Retry after 5s:", err)
+			select {
+			case <-worker.ctx.Done():
+				return
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+
+		switch {
+		case meta.LastIndex < index:
+			// Consul state was restored, start over
+			index = 0
+			continue
+		case meta.LastIndex == index:
+			// Wait timed out without changes
+			continue
+		}
+		index = meta.LastIndex
+		worker.reloadConfig(pairs)
+	}
+}
+
+// reloadConfig resolves config with Consul pairs and applies keys changed
+// since the previous update. Keys tagged hot are applied to the running
+// pipeline, changes of other keys are rejected until restart. Invalid
+// update is rejected entirely.
+func (worker *Worker) reloadConfig(pairs consul.KVPairs) {
+	desired := worker.localConfig.clone()
+	err := desired.fillFromPairs(pairs, configPrefix)
+	if err == nil {
+		err = desired.Validate()
+	}
+	if err != nil {
+		log.Println("Rejected config update:", err)
+		worker.ConfigChanges.Add(ConfigChange{Time: time.Now()}, err)
+		return
+	}
+
+	previous := worker.desired
+	worker.desired = desired
+
+	structType := reflect.TypeOf(*desired)
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		key, _ := configKey(field)
+		if key == "" || desired.Get(key) == previous.Get(key) {
+			continue
+		}
+		// Rejected change reverted, nothing to apply
+		if desired.Get(key) == worker.Config.Get(key) {
+			continue
+		}
+
+		change := ConfigChange{
+			Time: time.Now(),
+			Key:  key,
+			From: maskConfigValue(field, worker.Config.Get(key)),
+			To:   maskConfigValue(field, desired.Get(key)),
+		}
+
+		err := fmt.Errorf("%s can't be changed without restart", key)
+		if field.Tag.Get("hot") == "true" {
+			err = worker.applyConfig(key, desired)
+		}
+		if err != nil {
+			log.Printf("Rejected change of %s from %q to %q: %s", key, change.From, change.To, err)
+			worker.ConfigChanges.Add(change, err)
+			continue
+		}
+
+		change.Applied = true
+		log.Printf("Applied change of %s from %q to %q", key, change.From, change.To)
+		worker.ConfigChanges.Add(change, nil)
+	}
+}
+
+// applyConfig sets key to its desired value and applies it to rings,
+// sinks or their batches
+func (worker *Worker) applyConfig(key string, desired *Config) error {
+	previous := worker.Config.Get(key)
+	err := worker.Config.set(key, desired.Get(key), desired.sources[key])
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case key == "ring_size":
+		worker.resizeRings(worker.Config.RingSize)
+	case strings.HasSuffix(key, "_enabled"):
+		name := strings.TrimSuffix(key, "_enabled")
+		if worker.Config.Bool(key) {
+			err = worker.enableSink(name)
+		} else {
+			worker.disableSink(name)
+		}
+	case strings.Contains(key, "_batch_"):
+		worker.updateBatches()
+	}
+
+	if err != nil {
+		worker.Config.set(key, previous, worker.Config.sources[key])
+	}
+	return err
+}
+
+func (worker *Worker) resizeRings(size int) {
+	for _, tracker := range worker.Trackers {
+		tracker.SuccessRing.Resize(size)
+		tracker.FailRing.Resize(size)
+	}
+	for _, sink := range worker.sinks() {
+		for _, bus := range sink.Buses {
+			bus.SuccessRing.Resize(size)
+			bus.FailRing.Resize(size)
+		}
+	}
+}
+
+// enableSink starts registered sink name unless it's already running
+func (worker *Worker) enableSink(name string) error {
+	if _, exist := sinkDrivers[name]; !exist {
+		return fmt.Errorf("Unknown sink: %s", name)
+	}
+
+	worker.sinksLock.Lock()
+	defer worker.sinksLock.Unlock()
+
+	if worker.ctx.Err() != nil {
+		return errShuttingDown
+	}
+	for _, sink := range worker.Sinks {
+		if sink.Name == name {
+			return nil
+		}
+	}
+
+	sink := newSink(name, worker.Config, worker.Trackers, worker.Config.RingSize)
+	err := worker.openSpill(sink)
+	if err != nil {
+		return err
+	}
+	worker.Sinks = append(worker.Sinks, sink)
+	sort.Slice(worker.Sinks, func(i, j int) bool {
+		return worker.Sinks[i].Name < worker.Sinks[j].Name
+	})
+	worker.runSink(sink)
+	return nil
+}
+
+// disableSink stops forwarding events to sink name. Events already in its
+// buses are written before the sink is closed, requeued if it's down.
+// Returns once the sink is stopped, so its spill can be opened again.
+func (worker *Worker) disableSink(name string) {
+	var disabled *SinkState
+	for _, sink := range worker.sinks() {
+		if sink.Name == name {
+			disabled = sink
+		}
+	}
+	if disabled == nil {
+		return
+	}
+	// Releases forwarding stalled on the sink, so it can be removed
+	disabled.Disable()
+
+	worker.sinksLock.Lock()
+	started := disabled.started
+	for i, sink := range worker.Sinks {
+		if sink == disabled {
+			worker.Sinks = append(worker.Sinks[:i:i], worker.Sinks[i+1:]...)
+			break
+		}
+	}
+	worker.sinksLock.Unlock()
+
+	for _, bus := range disabled.Buses {
+		bus.Close()
+	}
+	if started {
+		<-disabled.stopped
+	}
+}
+
+// updateBatches sets batch limits of every running sink from config
+func (worker *Worker) updateBatches() {
+	for _, sink := range worker.sinks() {
+		driver, exist := sinkDrivers[sink.Name]
+		if !exist {
+			continue
+		}
+		for tracker, bus := range sink.Buses {
+			bus.SetLimits(driver.limits(worker.Config, sink.Name, tracker))
+		}
+	}
+}
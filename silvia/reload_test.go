@@ -0,0 +1,137 @@
+package silvia
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func newTestReloadWorker(t *testing.T, dir string) *Worker {
+	local := &Config{}
+	err := local.fillFromDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	local.set("archive_dir", dir, "test")
+
+	worker := newTestReplayWorker(&testSink{})
+	worker.localConfig = local
+	worker.Config = local.clone()
+	worker.desired = local.clone()
+	worker.ConfigChanges = NewRing[ConfigChange](configChangesSize)
+	worker.ctx, worker.stop = context.WithCancel(context.Background())
+	worker.Sinks = []*SinkState{newSink("redshift", worker.Config, worker.Trackers, worker.Config.RingSize)}
+	return worker
+}
+
+func testPairs(values map[string]string) consul.KVPairs {
+	var pairs consul.KVPairs
+	for key, value := range values {
+		pairs = append(pairs, &consul.KVPair{Key: configPrefix + "/" + key, Value: []byte(value)})
+	}
+	return pairs
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	worker := newTestReloadWorker(t, dir)
+	values := map[string]string{
+		"ring_size":                  "3",
+		"redshift_adjust_batch_rows": "5",
+		"archive_enabled":            "true",
+		"port":                       "9999",
+		"unknown_key":                "1",
+	}
+	worker.reloadConfig(testPairs(values))
+
+	if size := worker.Trackers[0].SuccessRing.Display().Size; size != 3 {
+		t.Errorf("Rings must be resized, got size %d", size)
+	}
+	if rows := worker.Sinks[1].Buses["adjust"].Limits().MaxRows; rows != 5 {
+		t.Errorf("Batch limits must be changed, got %d rows", rows)
+	}
+	if len(worker.Sinks) != 2 || worker.Sinks[0].Name != "archive" {
+		t.Fatalf("Archive must be enabled: %v", worker.Sinks)
+	}
+	if worker.Config.Port != 8080 {
+		t.Errorf("Port must not be changed without restart, got %d", worker.Config.Port)
+	}
+
+	changes := worker.ConfigChanges.Display()
+	results := map[string]string{}
+	for _, item := range changes.Ring {
+		results[item.Event.Key] = item.Error
+		if item.Event.Applied != (item.Error == "") {
+			t.Errorf("Unexpected change: %+v", item)
+		}
+	}
+	expected := map[string]string{
+		"ring_size":                  "",
+		"redshift_adjust_batch_rows": "",
+		"archive_enabled":            "",
+		"port":                       "port can't be changed without restart",
+	}
+	if len(results) != len(expected) {
+		t.Errorf("Unexpected changes: %v", changes.Ring)
+	}
+	for key, err := range expected {
+		if result, exist := results[key]; !exist || result != err {
+			t.Errorf("Unexpected change of %s: %q", key, result)
+		}
+	}
+
+	// Unchanged update and rejected value seen again are not logged
+	worker.reloadConfig(testPairs(values))
+	if total := worker.ConfigChanges.Total(); total != changes.Total {
+		t.Errorf("Unchanged keys must not be reported, got %d changes", total)
+	}
+
+	values["ring_size"] = "ten"
+	worker.reloadConfig(testPairs(values))
+	if size := worker.Trackers[0].SuccessRing.Display().Size; size != 3 || worker.ConfigChanges.Total() != changes.Total+1 {
+		t.Errorf("Invalid update must be rejected entirely")
+	}
+
+	archive := worker.Sinks[0]
+	values["ring_size"] = "3"
+	values["archive_enabled"] = "false"
+	worker.reloadConfig(testPairs(values))
+	if len(worker.Sinks) != 1 || worker.Sinks[0].Name != "redshift" {
+		t.Errorf("Archive must be disabled: %v", worker.Sinks)
+	}
+	// Archive is closed once its buses are drained, before it's removed
+	select {
+	case <-archive.stopped:
+	default:
+		t.Errorf("Disabled archive must be stopped before it can be enabled again")
+	}
+	worker.pipeline.Wait()
+}
+
+func TestReloadConfigShuttingDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	worker := newTestReloadWorker(t, dir)
+	worker.stop()
+	worker.reloadConfig(testPairs(map[string]string{"archive_enabled": "true"}))
+
+	if len(worker.Sinks) != 1 || worker.Config.ArchiveEnabled {
+		t.Errorf("Sinks must not be started on shutdown")
+	}
+	item := worker.ConfigChanges.Display().Ring[0]
+	if item.Event.Applied || item.Error != errShuttingDown.Error() {
+		t.Errorf("Unexpected change: %+v", item)
+	}
+}
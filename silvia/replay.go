@@ -0,0 +1,340 @@
+package silvia
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// How long replay waits for sinks to connect
+const replayConnectTimeout = 30 * time.Second
+
+// Max length of a line in replayed files
+const replayMaxPayload = 4 << 20
+
+// Error types of rows TableSource reads by default, rows failed to be
+// written are not replayed as their payloads are valid
+var replayErrorTypes = []string{"Transform", "Schema"}
+
+type (
+	// ReplaySource reads raw payloads of a tracker to be transformed and
+	// written again
+	ReplaySource interface {
+		Open(config *Config, tracker Tracker) error
+		// Read pushes deliveries to bus until the source is exhausted.
+		// Results of deliveries are reported to acknowledger.
+		Read(bus chan<- *Delivery, acknowledger amqp.Acknowledger) error
+		Close() error
+	}
+
+	// ReplayResults counts replayed payloads by outcome
+	ReplayResults struct {
+		sync.Mutex
+		Written int
+		Failed  int
+	}
+
+	// FileSource reads a raw payload per line. Files with .ndjson or
+	// .ndjson.gz extension are read as archive, a record per line.
+	FileSource struct {
+		Path   string
+		file   *os.File
+		reader io.Reader
+	}
+
+	// TableSource reads error_event column of rows failed to transform
+	// or validate from sink database, of ErrorTypes if they're set
+	TableSource struct {
+		Sink       string
+		ErrorTypes []string
+		db         *sql.DB
+		table      Table
+	}
+
+	// QueueSource reads RabbitMQ queue until it's empty. Failed messages
+	// are returned to the queue when the source is closed.
+	QueueSource struct {
+		sync.Mutex
+		Queue  string
+		rabbit *Rabbit
+		failed []uint64
+	}
+
+	queueAcknowledger struct {
+		source       *QueueSource
+		acknowledger amqp.Acknowledger
+		results      amqp.Acknowledger
+	}
+)
+
+// LoadReplay resolves config and builds the pipeline, the service is not
+// registered. Spills are left to the running service.
+func (worker *Worker) LoadReplay() error {
+	worker.replaying = true
+	return worker.loadPipeline()
+}
+
+// Replay transforms payloads from source with tracker and writes them to
+// every enabled sink. Payloads failed again are left in the source.
+func (worker *Worker) Replay(trackerName string, source ReplaySource) (*ReplayResults, error) {
+	var replayed *TrackerState
+	for _, tracker := range worker.Trackers {
+		if tracker.Tracker.Name() == trackerName {
+			replayed = tracker
+		}
+	}
+	if replayed == nil {
+		return nil, fmt.Errorf("Unknown tracker: %s", trackerName)
+	}
+	if len(worker.sinks()) == 0 {
+		return nil, errors.New("No sinks enabled")
+	}
+
+	err := source.Open(worker.Config, replayed.Tracker)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+
+	worker.replaying = true
+	worker.Writer()
+	err = worker.waitSinks(replayConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tracker := range worker.Trackers {
+		if tracker != replayed {
+			close(tracker.RequestBus)
+		}
+	}
+	worker.Transformer()
+
+	results := &ReplayResults{}
+	err = source.Read(replayed.RequestBus, results)
+	close(replayed.RequestBus)
+	worker.pipeline.Wait()
+
+	return results, err
+}
+
+// waitSinks waits until every sink is connected
+func (worker *Worker) waitSinks(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, sink := range worker.sinks() {
+		for !sink.Health.Get() {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("Can't connect to %s", sink.Name)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+func (results *ReplayResults) Ack(tag uint64, multiple bool) error {
+	results.Lock()
+	results.Written++
+	results.Unlock()
+	return nil
+}
+
+func (results *ReplayResults) Nack(tag uint64, multiple bool, requeue bool) error {
+	results.Lock()
+	results.Failed++
+	results.Unlock()
+	return nil
+}
+
+func (results *ReplayResults) Reject(tag uint64, requeue bool) error {
+	return results.Nack(tag, false, requeue)
+}
+
+func (source *FileSource) Open(config *Config, tracker Tracker) error {
+	var err error
+	source.file, err = os.Open(source.Path)
+	if err != nil {
+		return err
+	}
+
+	source.reader = source.file
+	if strings.HasSuffix(source.Path, ".gz") {
+		source.reader, err = gzip.NewReader(source.file)
+	}
+	return err
+}
+
+func (source *FileSource) Read(bus chan<- *Delivery, acknowledger amqp.Acknowledger) error {
+	scanner := bufio.NewScanner(source.reader)
+	scanner.Buffer(make([]byte, 64*1024), replayMaxPayload)
+	archived := strings.HasSuffix(strings.TrimSuffix(source.Path, ".gz"), ".ndjson")
+
+	var tag uint64
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		tag++
+
+		delivery := &Delivery{
+			Body:         append([]byte(nil), scanner.Bytes()...),
+			Tag:          tag,
+			Received:     time.Now().UTC(),
+			acknowledger: acknowledger,
+		}
+		if archived {
+			record := &ArchiveRecord{}
+			err := json.Unmarshal(scanner.Bytes(), record)
+			if err != nil {
+				log.Printf("Can't decode archive record %.100s: %s", scanner.Text(), err)
+				acknowledger.Reject(tag, false)
+				continue
+			}
+			delivery.Body = record.Payload()
+			delivery.Received = record.Received
+		}
+		bus <- delivery
+	}
+	return scanner.Err()
+}
+
+func (source *FileSource) Close() error {
+	return source.file.Close()
+}
+
+func (source *TableSource) Open(config *Config, tracker Tracker) error {
+	connect := config.Get(source.Sink + "_connect")
+	if connect == "" {
+		return fmt.Errorf("No connection configured for %s", source.Sink)
+	}
+
+	var err error
+	source.db, err = sql.Open("postgres", connect)
+	source.table = tracker.Table()
+	return err
+}
+
+func (source *TableSource) Read(bus chan<- *Delivery, acknowledger amqp.Acknowledger) error {
+	query, args := source.query()
+	rows, err := source.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var tag uint64
+	for rows.Next() {
+		var errorEvent string
+		err = rows.Scan(&errorEvent)
+		if err != nil {
+			return err
+		}
+		tag++
+
+		// error_event holds payload as Go string literal
+		payload, err := strconv.Unquote(errorEvent)
+		if err != nil {
+			log.Printf("Can't decode error_event %.100s: %s", errorEvent, err)
+			acknowledger.Reject(tag, false)
+			continue
+		}
+
+		bus <- &Delivery{
+			Body:         []byte(payload),
+			Tag:          tag,
+			Received:     time.Now().UTC(),
+			acknowledger: acknowledger,
+		}
+	}
+	return rows.Err()
+}
+
+// query selects error_event of rows of the error types
+func (source *TableSource) query() (string, []interface{}) {
+	errTypes := source.ErrorTypes
+	if len(errTypes) == 0 {
+		errTypes = replayErrorTypes
+	}
+	args := make([]interface{}, len(errTypes))
+	for i, errType := range errTypes {
+		args[i] = errType
+	}
+	query := fmt.Sprintf(`SELECT "error_event" FROM "%s"."%s" WHERE "error_type" IN (%s) AND "error_event" IS NOT NULL`,
+		source.table.Schema, source.table.Name, strings.Join(makeRange(1, len(errTypes)), ", "))
+	return query, args
+}
+
+func (source *TableSource) Close() error {
+	return source.db.Close()
+}
+
+func (source *QueueSource) Open(config *Config, tracker Tracker) error {
+	source.rabbit = &Rabbit{}
+	err := source.rabbit.Connect(config)
+	if err != nil {
+		return err
+	}
+
+	source.rabbit.Channel, err = source.rabbit.Connection.Channel()
+	return err
+}
+
+func (source *QueueSource) Read(bus chan<- *Delivery, acknowledger amqp.Acknowledger) error {
+	for {
+		d, ok, err := source.rabbit.Channel.Get(source.Queue, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		bus <- &Delivery{
+			Body:         d.Body,
+			Tag:          d.DeliveryTag,
+			Received:     time.Now().UTC(),
+			acknowledger: &queueAcknowledger{source: source, acknowledger: d.Acknowledger, results: acknowledger},
+		}
+	}
+}
+
+// Close returns failed messages to the queue. They are not requeued right
+// away, otherwise Read would get them again.
+func (source *QueueSource) Close() error {
+	for _, tag := range source.failed {
+		err := source.rabbit.Channel.Nack(tag, false, true)
+		if err != nil {
+			log.Println("Can't return message to queue:", err)
+		}
+	}
+	return source.rabbit.Connection.Close()
+}
+
+func (ack *queueAcknowledger) Ack(tag uint64, multiple bool) error {
+	ack.results.Ack(tag, multiple)
+	return ack.acknowledger.Ack(tag, multiple)
+}
+
+func (ack *queueAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	ack.results.Nack(tag, multiple, requeue)
+	ack.source.Lock()
+	ack.source.failed = append(ack.source.failed, tag)
+	ack.source.Unlock()
+	return nil
+}
+
+func (ack *queueAcknowledger) Reject(tag uint64, requeue bool) error {
+	return ack.Nack(tag, false, requeue)
+}
@@ -0,0 +1,107 @@
+package silvia
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func newTestReplayWorker(sink *testSink) *Worker {
+	var trackers []*TrackerState
+	for _, tracker := range []Tracker{&AdjustTracker{}, &SnowplowTracker{}} {
+		trackers = append(trackers, &TrackerState{
+			Tracker:     tracker,
+			RequestBus:  make(chan *Delivery),
+			SuccessRing: NewRing[Event](10),
+			FailRing:    NewRing[Event](10),
+		})
+	}
+	return &Worker{
+		Config:   &Config{},
+		Trackers: trackers,
+		Sinks:    []*SinkState{newTestSinkState(sink, 1)},
+		ctx:      context.Background(),
+	}
+}
+
+func TestReplayFile(t *testing.T) {
+	file, err := ioutil.TempFile("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(transformResults[0].request + "\n\n%zz\n" + transformResults[1].request + "\n")
+	file.Close()
+
+	sink := &testSink{batches: map[Table][][]Event{}}
+	worker := newTestReplayWorker(sink)
+
+	results, err := worker.Replay("adjust", &FileSource{Path: file.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results.Written != 2 || results.Failed != 1 {
+		t.Errorf("Unexpected results: %d written, %d failed", results.Written, results.Failed)
+	}
+
+	batches := sink.batches[Table{Schema: "adjust", Name: "events"}]
+	if len(batches) != 2 {
+		t.Fatalf("Failed payload must not be written, got %d batches", len(batches))
+	}
+	for _, batch := range batches {
+		if batch[0].(*AdjustEvent).ErrType.Valid {
+			t.Errorf("Unexpected failure row written")
+		}
+	}
+	if !sink.closed {
+		t.Errorf("Sink must be closed after replay")
+	}
+}
+
+func TestReplayUnknownTracker(t *testing.T) {
+	worker := newTestReplayWorker(&testSink{})
+	_, err := worker.Replay("mixpanel", &FileSource{Path: os.DevNull})
+	if err == nil {
+		t.Errorf("Unknown tracker must fail")
+	}
+}
+
+func TestQueueAcknowledger(t *testing.T) {
+	source := &QueueSource{}
+	queue := &testAcknowledger{}
+	results := &ReplayResults{}
+
+	(&queueAcknowledger{source: source, acknowledger: queue, results: results}).Ack(1, false)
+	(&queueAcknowledger{source: source, acknowledger: queue, results: results}).Nack(2, false, true)
+
+	if len(queue.acks) != 1 || len(queue.nacks) != 0 {
+		t.Errorf("Failed message must not be requeued before source is closed")
+	}
+	if len(source.failed) != 1 || source.failed[0] != 2 {
+		t.Errorf("Failed message must be kept: %v", source.failed)
+	}
+	if results.Written != 1 || results.Failed != 1 {
+		t.Errorf("Unexpected results: %d written, %d failed", results.Written, results.Failed)
+	}
+}
+
+func TestTableSourceQuery(t *testing.T) {
+	for _, testCase := range []struct {
+		title      string
+		errorTypes []string
+		in         string
+		args       []interface{}
+	}{
+		{`Rows failed to transform or validate by default`, nil, "($1, $2)", []interface{}{"Transform", "Schema"}},
+		{`Rows of given error type`, []string{"Schema"}, "($1)", []interface{}{"Schema"}},
+	} {
+		source := &TableSource{ErrorTypes: testCase.errorTypes, table: Table{Schema: "atomic", Name: "events"}}
+		query, args := source.query()
+		expected := `SELECT "error_event" FROM "atomic"."events" WHERE "error_type" IN ` + testCase.in + ` AND "error_event" IS NOT NULL`
+		if query != expected || !reflect.DeepEqual(args, testCase.args) {
+			t.Errorf("Failed on: %s\nQuery: %s\nArgs: %v", testCase.title, query, args)
+		}
+	}
+}
@@ -3,71 +3,93 @@ package silvia
 import "sync"
 
 type (
-	AdjustRingItem struct {
-		Event *AdjustEvent
-		Error error
+	RingItem[T any] struct {
+		Event T
+		Error string `json:",omitempty"`
 	}
 
-	AdjustRing struct {
+	// Ring keeps last Size items, every Add overwrites the oldest one once
+	// it's full. Items must not be changed after they are added.
+	Ring[T any] struct {
 		sync.RWMutex
-		Ring  []*AdjustRingItem
-		Total int
-		Size  int
+		items []RingItem[T]
+		next  int
+		total int
 	}
 
-	SnowplowRingItem struct {
-		Event *SnowplowEvent
-		Error error
-	}
-
-	SnowplowRing struct {
-		sync.RWMutex
-		Ring  []*SnowplowRingItem
+	// RingSnapshot is a copy of ring contents, oldest item first
+	RingSnapshot[T any] struct {
+		Ring  []RingItem[T]
 		Total int
 		Size  int
 	}
 )
 
-func (ring *AdjustRing) Add(event *AdjustEvent, err error) {
-	ringItem := &AdjustRingItem{
-		Event: event,
-		Error: err,
+func NewRing[T any](size int) *Ring[T] {
+	if size < 0 {
+		size = 0
 	}
-
-	ring.Lock()
-	ring.Ring = append(ring.Ring, ringItem)
-	ring.Total++
-
-	if len(ring.Ring) > ring.Size {
-		ring.Ring = ring.Ring[1:]
-	}
-	ring.Unlock()
+	return &Ring[T]{items: make([]RingItem[T], 0, size)}
 }
 
-func (ring *SnowplowRing) Add(event *SnowplowEvent, err error) {
-	ringItem := &SnowplowRingItem{
-		Event: event,
-		Error: err,
+func (ring *Ring[T]) Add(event T, err error) {
+	ringItem := RingItem[T]{Event: event}
+	if err != nil {
+		ringItem.Error = err.Error()
 	}
 
 	ring.Lock()
-	ring.Ring = append(ring.Ring, ringItem)
-	ring.Total++
+	defer ring.Unlock()
 
-	if len(ring.Ring) > ring.Size {
-		ring.Ring = ring.Ring[1:]
+	ring.total++
+	if cap(ring.items) == 0 {
+		return
+	}
+	if len(ring.items) < cap(ring.items) {
+		ring.items = append(ring.items, ringItem)
+		return
 	}
-	ring.Unlock()
+	ring.items[ring.next] = ringItem
+	ring.next = (ring.next + 1) % len(ring.items)
 }
 
-func (ring *AdjustRing) Display() AdjustRing {
+// Total returns count of items ever added
+func (ring *Ring[T]) Total() int {
 	ring.RLock()
 	defer ring.RUnlock()
-	return *ring
+	return ring.total
 }
 
-func (ring *SnowplowRing) Display() SnowplowRing {
+func (ring *Ring[T]) Display() RingSnapshot[T] {
 	ring.RLock()
 	defer ring.RUnlock()
-	return *ring
+
+	snapshot := RingSnapshot[T]{
+		Ring:  make([]RingItem[T], 0, len(ring.items)),
+		Total: ring.total,
+		Size:  cap(ring.items),
+	}
+	snapshot.Ring = append(snapshot.Ring, ring.items[ring.next:]...)
+	snapshot.Ring = append(snapshot.Ring, ring.items[:ring.next]...)
+	return snapshot
+}
+
+// Resize changes capacity of the ring keeping the newest items
+func (ring *Ring[T]) Resize(size int) {
+	if size < 0 {
+		size = 0
+	}
+
+	ring.Lock()
+	defer ring.Unlock()
+
+	ordered := make([]RingItem[T], 0, len(ring.items))
+	ordered = append(ordered, ring.items[ring.next:]...)
+	ordered = append(ordered, ring.items[:ring.next]...)
+	if len(ordered) > size {
+		ordered = ordered[len(ordered)-size:]
+	}
+
+	ring.items = append(make([]RingItem[T], 0, size), ordered...)
+	ring.next = 0
 }
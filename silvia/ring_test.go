@@ -0,0 +1,152 @@
+package silvia
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+var ringResults = []struct {
+	title    string
+	size     int
+	adds     int
+	expected []int
+}{
+	{`Empty ring`, 3, 0, []int{}},
+	{`Partially filled ring`, 3, 2, []int{0, 1}},
+	{`Full ring`, 3, 3, []int{0, 1, 2}},
+	{`Overwritten ring`, 3, 7, []int{4, 5, 6}},
+	{`Zero size ring`, 0, 5, []int{}},
+}
+
+func TestRing(t *testing.T) {
+	for _, testCase := range ringResults {
+		ring := NewRing[int](testCase.size)
+		for i := 0; i < testCase.adds; i++ {
+			ring.Add(i, nil)
+		}
+
+		snapshot := ring.Display()
+		events := []int{}
+		for _, item := range snapshot.Ring {
+			events = append(events, item.Event)
+		}
+		if !reflect.DeepEqual(events, testCase.expected) {
+			t.Errorf("Failed on: %s\nEvents: %v\nExpected: %v", testCase.title, events, testCase.expected)
+		}
+		if snapshot.Total != testCase.adds || ring.Total() != testCase.adds {
+			t.Errorf("Failed on: %s\nTotal: %d", testCase.title, snapshot.Total)
+		}
+		if snapshot.Size != testCase.size {
+			t.Errorf("Failed on: %s\nSize: %d", testCase.title, snapshot.Size)
+		}
+	}
+}
+
+var ringResizeResults = []struct {
+	title    string
+	size     int
+	adds     int
+	resize   int
+	expected []int
+}{
+	{`Grow partially filled ring`, 3, 2, 5, []int{0, 1, 2, 3}},
+	{`Grow overwritten ring`, 3, 7, 5, []int{4, 5, 6, 7, 8}},
+	{`Shrink overwritten ring`, 4, 6, 2, []int{6, 7}},
+	{`Shrink to zero`, 3, 5, 0, []int{}},
+}
+
+func TestRingResize(t *testing.T) {
+	for _, testCase := range ringResizeResults {
+		ring := NewRing[int](testCase.size)
+		for i := 0; i < testCase.adds; i++ {
+			ring.Add(i, nil)
+		}
+		ring.Resize(testCase.resize)
+		// Added after resize to check the ring keeps wrapping
+		for i := testCase.adds; i < testCase.adds+2; i++ {
+			ring.Add(i, nil)
+		}
+
+		snapshot := ring.Display()
+		events := []int{}
+		for _, item := range snapshot.Ring {
+			events = append(events, item.Event)
+		}
+		if !reflect.DeepEqual(events, testCase.expected) || snapshot.Size != testCase.resize {
+			t.Errorf("Failed on: %s\nEvents: %v, size %d\nExpected: %v", testCase.title, events, snapshot.Size, testCase.expected)
+		}
+		if snapshot.Total != testCase.adds+2 {
+			t.Errorf("Failed on: %s\nTotal: %d", testCase.title, snapshot.Total)
+		}
+	}
+}
+
+func TestRingSnapshot(t *testing.T) {
+	ring := NewRing[int](2)
+	ring.Add(1, errors.New("first failed"))
+	snapshot := ring.Display()
+
+	ring.Add(2, nil)
+	ring.Add(3, nil)
+	if len(snapshot.Ring) != 1 || snapshot.Ring[0].Event != 1 {
+		t.Errorf("Snapshot must not change on Add: %v", snapshot.Ring)
+	}
+
+	b, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"Ring":[{"Event":1,"Error":"first failed"}],"Total":1,"Size":2}` {
+		t.Errorf("Unexpected snapshot JSON: %s", b)
+	}
+}
+
+func TestRingConcurrentDisplay(t *testing.T) {
+	tracker := &TrackerState{
+		Tracker:     &AdjustTracker{},
+		SuccessRing: NewRing[Event](10),
+		FailRing:    NewRing[Event](10),
+	}
+	worker := &Worker{Trackers: []*TrackerState{tracker}}
+	server := httptest.NewServer(worker.ApiHandler(RingApi))
+	defer server.Close()
+
+	var adders sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		adders.Add(1)
+		go func() {
+			defer adders.Done()
+			for j := 0; j < 500; j++ {
+				event := &AdjustEvent{}
+				event.Transform([]byte(transformResults[0].request))
+				tracker.SuccessRing.Add(event, nil)
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		response, err := http.Get(server.URL + "?tracker=adjust&ring=success")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rings []RingSnapshot[json.RawMessage]
+		err = json.NewDecoder(response.Body).Decode(&rings)
+		response.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rings) != 1 || len(rings[0].Ring) > 10 {
+			t.Fatalf("Unexpected ring: %+v", rings)
+		}
+	}
+	adders.Wait()
+
+	if total := tracker.SuccessRing.Total(); total != 2000 {
+		t.Errorf("Expected 2000 events added, got %d", total)
+	}
+}
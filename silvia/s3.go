@@ -0,0 +1,154 @@
+package silvia
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3 is a minimal client for S3-compatible object storages (AWS, MinIO),
+// enough to upload and remove staging files for Redshift COPY. Requests are signed
+// with AWS Signature Version 4 and use path-style addressing.
+type S3 struct {
+	Endpoint   *url.URL
+	Region     string
+	Bucket     string
+	AccessKey  string
+	SecretKey  string
+	HttpClient *http.Client
+}
+
+func NewS3(config *Config) (*S3, error) {
+	endpoint, err := url.Parse(config.S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint must be absolute URL, got %q", config.S3Endpoint)
+	}
+
+	s3 := &S3{
+		Endpoint:   endpoint,
+		Region:     config.S3Region,
+		Bucket:     config.S3Bucket,
+		AccessKey:  config.S3AccessKey,
+		SecretKey:  config.S3SecretKey,
+		HttpClient: http.DefaultClient,
+	}
+	if s3.Region == "" {
+		s3.Region = "us-east-1"
+	}
+	return s3, nil
+}
+
+// URL returns s3:// location of key, as expected by COPY and manifests.
+func (s3 *S3) URL(key string) string {
+	return "s3://" + s3.Bucket + "/" + key
+}
+
+func (s3 *S3) PutObject(key string, body []byte, contentType string) error {
+	objectURL := *s3.Endpoint
+	objectURL.Path = "/" + s3.Bucket + "/" + key
+
+	request, err := http.NewRequest(http.MethodPut, objectURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	s3.sign(request, body, time.Now().UTC())
+
+	response, err := s3.HttpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Can't put %s to S3: %s %s", key, response.Status, message)
+	}
+	return nil
+}
+
+// DeleteObject removes key, deleting a missing key succeeds as well
+func (s3 *S3) DeleteObject(key string) error {
+	objectURL := *s3.Endpoint
+	objectURL.Path = "/" + s3.Bucket + "/" + key
+
+	request, err := http.NewRequest(http.MethodDelete, objectURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	s3.sign(request, nil, time.Now().UTC())
+
+	response, err := s3.HttpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("Can't delete %s from S3: %s %s", key, response.Status, message)
+	}
+	return nil
+}
+
+func (s3 *S3) sign(request *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		"host:" + request.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s3.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s3.SecretKey), date)
+	signingKey = hmacSHA256(signingKey, s3.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3.AccessKey, scope, signedHeaders, signature,
+	))
+}
+
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
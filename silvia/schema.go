@@ -0,0 +1,566 @@
+package silvia
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Vendor of Snowplow wrapper schemas of contexts and unstructured events
+const snowplowVendor = "com.snowplowanalytics.snowplow"
+
+var (
+	schemaVersionPattern = regexp.MustCompile(`^[0-9]+-[0-9]+-[0-9]+$`)
+	uuidPattern          = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+type (
+	// SchemaKey is an Iglu schema URI, iglu:vendor/name/format/version
+	SchemaKey struct {
+		Vendor  string `json:"vendor"`
+		Name    string `json:"name"`
+		Format  string `json:"format"`
+		Version string `json:"version"`
+	}
+
+	// SelfDescribing is JSON data with URI of its schema
+	SelfDescribing struct {
+		Schema string          `json:"schema"`
+		Data   json.RawMessage `json:"data"`
+	}
+
+	// Schema is a JSON Schema of the draft 4 keywords used by Iglu
+	// schemas. Schemas with composition keywords aren't supported, other
+	// keywords are ignored.
+	Schema struct {
+		Self                 *SchemaKey         `json:"self"`
+		Description          string             `json:"description"`
+		Type                 SchemaTypes        `json:"type"`
+		Properties           map[string]*Schema `json:"properties"`
+		Required             []string           `json:"required"`
+		AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+		Items                *Schema            `json:"items"`
+		Enum                 []interface{}      `json:"enum"`
+		MinLength            *int               `json:"minLength"`
+		MaxLength            *int               `json:"maxLength"`
+		Minimum              *float64           `json:"minimum"`
+		Maximum              *float64           `json:"maximum"`
+		ExclusiveMinimum     bool               `json:"exclusiveMinimum"`
+		ExclusiveMaximum     bool               `json:"exclusiveMaximum"`
+		MultipleOf           *float64           `json:"multipleOf"`
+		MinItems             *int               `json:"minItems"`
+		MaxItems             *int               `json:"maxItems"`
+		UniqueItems          bool               `json:"uniqueItems"`
+		MinProperties        *int               `json:"minProperties"`
+		MaxProperties        *int               `json:"maxProperties"`
+		Pattern              string             `json:"pattern"`
+		Format               string             `json:"format"`
+
+		// Keywords which aren't supported, kept to reject schemas
+		Ref               json.RawMessage `json:"$ref"`
+		OneOf             json.RawMessage `json:"oneOf"`
+		AnyOf             json.RawMessage `json:"anyOf"`
+		AllOf             json.RawMessage `json:"allOf"`
+		Not               json.RawMessage `json:"not"`
+		PatternProperties json.RawMessage `json:"patternProperties"`
+		Dependencies      json.RawMessage `json:"dependencies"`
+		AdditionalItems   json.RawMessage `json:"additionalItems"`
+
+		// Schema of properties not listed, nil if any are allowed
+		additional *Schema
+		closed     bool
+		pattern    *regexp.Regexp
+	}
+
+	// SchemaTypes is type keyword, a single type or a list of them
+	SchemaTypes []string
+
+	// SchemaRegistry is a local Iglu repository, schemas are kept in
+	// vendor/name/jsonschema/version files of its directory
+	SchemaRegistry struct {
+		Dir     string
+		schemas map[SchemaKey]*Schema
+		// Shredded table of every schema, shared by schemas of a model
+		tables map[SchemaKey]*ShredTable
+	}
+
+	// SchemaError is a self-describing JSON of event field which failed
+	// validation against its schema
+	SchemaError struct {
+		Field  string
+		Schema string
+		Err    error
+	}
+)
+
+// ParseSchemaKey parses iglu: schema URI
+func ParseSchemaKey(uri string) (SchemaKey, error) {
+	parts := strings.Split(strings.TrimPrefix(uri, "iglu:"), "/")
+	if !strings.HasPrefix(uri, "iglu:") || len(parts) != 4 || !schemaVersionPattern.MatchString(parts[3]) {
+		return SchemaKey{}, fmt.Errorf("Invalid schema URI %q", uri)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return SchemaKey{}, fmt.Errorf("Invalid schema URI %q", uri)
+		}
+	}
+	return SchemaKey{Vendor: parts[0], Name: parts[1], Format: parts[2], Version: parts[3]}, nil
+}
+
+func (key SchemaKey) String() string {
+	return "iglu:" + key.Vendor + "/" + key.Name + "/" + key.Format + "/" + key.Version
+}
+
+// Model is major version of schema, versions of a model are compatible
+func (key SchemaKey) Model() int {
+	model, _ := strconv.Atoi(strings.SplitN(key.Version, "-", 2)[0])
+	return model
+}
+
+func (types *SchemaTypes) UnmarshalJSON(b []byte) error {
+	var single string
+	if json.Unmarshal(b, &single) == nil {
+		*types = SchemaTypes{single}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(types))
+}
+
+// Has reports whether jsonType is allowed, integers are numbers too
+func (types SchemaTypes) Has(jsonType string) bool {
+	for _, schemaType := range types {
+		if schemaType == jsonType || schemaType == "number" && jsonType == "integer" {
+			return true
+		}
+	}
+	return false
+}
+
+func (err *SchemaError) Error() string {
+	if err.Schema == "" {
+		return fmt.Sprintf("%s: %s", err.Field, err.Err)
+	}
+	return fmt.Sprintf("%s %s: %s", err.Field, err.Schema, err.Err)
+}
+
+func (err *SchemaError) Unwrap() error {
+	return err.Err
+}
+
+// LoadSchemas reads every schema of Iglu repository in dir. Schema files
+// are named by version, with optional .json extension, other files such as
+// READMEs are skipped.
+func LoadSchemas(dir string) (*SchemaRegistry, error) {
+	registry := &SchemaRegistry{Dir: dir, schemas: map[SchemaKey]*Schema{}}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		version := strings.TrimSuffix(info.Name(), ".json")
+		if !schemaVersionPattern.MatchString(version) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, filepath.Join(filepath.Dir(path), version))
+		if err != nil {
+			return err
+		}
+		key, err := ParseSchemaKey("iglu:" + filepath.ToSlash(rel))
+		if err != nil || key.Format != "jsonschema" {
+			return fmt.Errorf("%s: expected vendor/name/jsonschema/version file", path)
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		schema := &Schema{}
+		err = json.Unmarshal(data, schema)
+		if err == nil && schema.Self != nil && *schema.Self != key {
+			err = fmt.Errorf("self is %s", schema.Self)
+		}
+		if err == nil {
+			err = schema.compile()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		registry.schemas[key] = schema
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	registry.tables = map[SchemaKey]*ShredTable{}
+	latest := map[string]SchemaKey{}
+	for key := range registry.schemas {
+		model := fmt.Sprintf("%s/%s/%s/%d", key.Vendor, key.Name, key.Format, key.Model())
+		if previous, exist := latest[model]; !exist || compareVersions(key.Version, previous.Version) > 0 {
+			latest[model] = key
+		}
+	}
+	for key := range registry.schemas {
+		model := latest[fmt.Sprintf("%s/%s/%s/%d", key.Vendor, key.Name, key.Format, key.Model())]
+		if _, exist := registry.tables[model]; !exist {
+			registry.tables[model] = newShredTable(model, registry.schemas[model])
+		}
+		registry.tables[key] = registry.tables[model]
+	}
+	return registry, nil
+}
+
+// compareVersions compares SchemaVer versions, model-revision-addition
+func compareVersions(a string, b string) int {
+	aParts := strings.Split(a, "-")
+	bParts := strings.Split(b, "-")
+	for i := range aParts {
+		aPart, _ := strconv.Atoi(aParts[i])
+		bPart, _ := strconv.Atoi(bParts[i])
+		if aPart != bPart {
+			return aPart - bPart
+		}
+	}
+	return 0
+}
+
+// compile prepares patterns and additional properties of schema and its
+// subschemas
+func (schema *Schema) compile() error {
+	if keyword := schema.unsupported(); keyword != "" {
+		return fmt.Errorf("unsupported keyword %s", keyword)
+	}
+	if schema.MultipleOf != nil && *schema.MultipleOf <= 0 {
+		return fmt.Errorf("multipleOf %v is not positive", *schema.MultipleOf)
+	}
+
+	var err error
+	if schema.Pattern != "" {
+		schema.pattern, err = regexp.Compile(schema.Pattern)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch additional := strings.TrimSpace(string(schema.AdditionalProperties)); {
+	case additional == "false":
+		schema.closed = true
+	case strings.HasPrefix(additional, "{"):
+		schema.additional = &Schema{}
+		err = json.Unmarshal(schema.AdditionalProperties, schema.additional)
+		if err == nil {
+			err = schema.additional.compile()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, property := range schema.Properties {
+		err = property.compile()
+		if err != nil {
+			return fmt.Errorf("%s: %s", name, err)
+		}
+	}
+	if schema.Items != nil {
+		return schema.Items.compile()
+	}
+	return nil
+}
+
+// unsupported returns the first keyword of schema which isn't supported
+func (schema *Schema) unsupported() string {
+	keywords := []struct {
+		name  string
+		value json.RawMessage
+	}{
+		{"$ref", schema.Ref},
+		{"oneOf", schema.OneOf},
+		{"anyOf", schema.AnyOf},
+		{"allOf", schema.AllOf},
+		{"not", schema.Not},
+		{"patternProperties", schema.PatternProperties},
+		{"dependencies", schema.Dependencies},
+		{"additionalItems", schema.AdditionalItems},
+	}
+	for _, keyword := range keywords {
+		if keyword.value != nil {
+			return keyword.name
+		}
+	}
+	return ""
+}
+
+// Validate checks data against schema of uri
+func (registry *SchemaRegistry) Validate(uri string, data json.RawMessage) error {
+	_, err := registry.shred(uri, data)
+	return err
+}
+
+// shred validates data against schema of uri and returns it as a row of
+// the table of schema model
+func (registry *SchemaRegistry) shred(uri string, data json.RawMessage) (*Shred, error) {
+	key, err := ParseSchemaKey(uri)
+	if err != nil {
+		return nil, err
+	}
+	schema, exist := registry.schemas[key]
+	if !exist {
+		return nil, fmt.Errorf("Unknown schema %s", uri)
+	}
+
+	var value interface{}
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		return nil, err
+	}
+	err = schema.Validate("data", value)
+	if err != nil {
+		return nil, err
+	}
+
+	object, _ := value.(map[string]interface{})
+	return &Shred{Key: key, Table: registry.tables[key], Data: object}, nil
+}
+
+// ValidateSnowplow checks every context of contexts and data of
+// unstructured event, which are wrapped in Snowplow schemas
+func (registry *SchemaRegistry) ValidateSnowplow(contexts string, unstructEvent string) error {
+	_, err := registry.ShredSnowplow(contexts, unstructEvent)
+	return err
+}
+
+// ShredSnowplow validates contexts and unstructured event like
+// ValidateSnowplow and returns them as shreds. Safe to call on nil,
+// nothing is validated or shredded then.
+func (registry *SchemaRegistry) ShredSnowplow(contexts string, unstructEvent string) ([]*Shred, error) {
+	if registry == nil {
+		return nil, nil
+	}
+
+	var shreds []*Shred
+	if contexts != "" {
+		var items []SelfDescribing
+		wrapper, err := unwrapSnowplow(contexts, "contexts", &items)
+		if err != nil {
+			return nil, &SchemaError{Field: "contexts", Schema: wrapper, Err: err}
+		}
+		for i, item := range items {
+			shred, err := registry.shred(item.Schema, item.Data)
+			if err != nil {
+				return nil, &SchemaError{Field: fmt.Sprintf("contexts[%d]", i), Schema: item.Schema, Err: err}
+			}
+			shreds = append(shreds, shred)
+		}
+	}
+
+	if unstructEvent != "" {
+		item := SelfDescribing{}
+		wrapper, err := unwrapSnowplow(unstructEvent, "unstruct_event", &item)
+		var shred *Shred
+		if err == nil {
+			shred, err = registry.shred(item.Schema, item.Data)
+			wrapper = item.Schema
+		}
+		if err != nil {
+			return nil, &SchemaError{Field: "unstruct_event", Schema: wrapper, Err: err}
+		}
+		shreds = append(shreds, shred)
+	}
+	return shreds, nil
+}
+
+// unwrapSnowplow decodes data of Snowplow wrapper schema name into
+// value, returns URI of the wrapper
+func unwrapSnowplow(raw string, name string, value interface{}) (string, error) {
+	wrapper := SelfDescribing{}
+	err := json.Unmarshal([]byte(raw), &wrapper)
+	if err != nil {
+		return "", err
+	}
+	key, err := ParseSchemaKey(wrapper.Schema)
+	if err != nil {
+		return wrapper.Schema, err
+	}
+	if key.Vendor != snowplowVendor || key.Name != name {
+		return wrapper.Schema, fmt.Errorf("Expected %s/%s schema", snowplowVendor, name)
+	}
+	return wrapper.Schema, json.Unmarshal(wrapper.Data, value)
+}
+
+// Validate checks value decoded from JSON, path names value in errors
+func (schema *Schema) Validate(path string, value interface{}) error {
+	valueType := jsonType(value)
+	if len(schema.Type) > 0 && !schema.Type.Has(valueType) {
+		return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(schema.Type, " or "), valueType)
+	}
+	if schema.Enum != nil && !inEnum(schema.Enum, value) {
+		return fmt.Errorf("%s: %s is not allowed", path, formatJSON(value))
+	}
+
+	switch value := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(value)
+		if schema.MinLength != nil && length < *schema.MinLength {
+			return fmt.Errorf("%s: shorter than %d characters", path, *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			return fmt.Errorf("%s: longer than %d characters", path, *schema.MaxLength)
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(value) {
+			return fmt.Errorf("%s: doesn't match %s", path, schema.Pattern)
+		}
+		if !validFormat(schema.Format, value) {
+			return fmt.Errorf("%s: invalid %s %q", path, schema.Format, value)
+		}
+
+	case float64:
+		if schema.Minimum != nil && (value < *schema.Minimum || schema.ExclusiveMinimum && value == *schema.Minimum) {
+			if schema.ExclusiveMinimum {
+				return fmt.Errorf("%s: not greater than %v", path, *schema.Minimum)
+			}
+			return fmt.Errorf("%s: less than %v", path, *schema.Minimum)
+		}
+		if schema.Maximum != nil && (value > *schema.Maximum || schema.ExclusiveMaximum && value == *schema.Maximum) {
+			if schema.ExclusiveMaximum {
+				return fmt.Errorf("%s: not less than %v", path, *schema.Maximum)
+			}
+			return fmt.Errorf("%s: greater than %v", path, *schema.Maximum)
+		}
+		if schema.MultipleOf != nil {
+			quotient := value / *schema.MultipleOf
+			if math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+				return fmt.Errorf("%s: not a multiple of %v", path, *schema.MultipleOf)
+			}
+		}
+
+	case []interface{}:
+		if schema.MinItems != nil && len(value) < *schema.MinItems {
+			return fmt.Errorf("%s: fewer than %d items", path, *schema.MinItems)
+		}
+		if schema.MaxItems != nil && len(value) > *schema.MaxItems {
+			return fmt.Errorf("%s: more than %d items", path, *schema.MaxItems)
+		}
+		if schema.UniqueItems {
+			for i := range value {
+				for j := 0; j < i; j++ {
+					if reflect.DeepEqual(value[i], value[j]) {
+						return fmt.Errorf("%s[%d]: same as item %d", path, i, j)
+					}
+				}
+			}
+		}
+		if schema.Items != nil {
+			for i, item := range value {
+				err := schema.Items.Validate(fmt.Sprintf("%s[%d]", path, i), item)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+	case map[string]interface{}:
+		if schema.MinProperties != nil && len(value) < *schema.MinProperties {
+			return fmt.Errorf("%s: fewer than %d properties", path, *schema.MinProperties)
+		}
+		if schema.MaxProperties != nil && len(value) > *schema.MaxProperties {
+			return fmt.Errorf("%s: more than %d properties", path, *schema.MaxProperties)
+		}
+		for _, name := range schema.Required {
+			if _, exist := value[name]; !exist {
+				return fmt.Errorf("%s.%s: required", path, name)
+			}
+		}
+
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			property, listed := schema.Properties[name]
+			switch {
+			case listed:
+			case schema.closed:
+				return fmt.Errorf("%s.%s: not allowed", path, name)
+			case schema.additional != nil:
+				property = schema.additional
+			default:
+				continue
+			}
+			err := property.Validate(path+"."+name, value[name])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// jsonType is JSON Schema type of value decoded from JSON
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if reflect.DeepEqual(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func formatJSON(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// validFormat checks value of format, unknown formats are valid
+func validFormat(format string, value string) bool {
+	switch format {
+	case "date-time":
+		_, err := time.Parse(time.RFC3339Nano, value)
+		return err == nil
+	case "uuid":
+		return uuidPattern.MatchString(value)
+	case "ipv4":
+		ip := net.ParseIP(value)
+		return ip != nil && ip.To4() != nil
+	case "ipv6":
+		return net.ParseIP(value) != nil && strings.Contains(value, ":")
+	case "email":
+		return strings.Contains(value, "@")
+	case "uri":
+		uri, err := url.Parse(value)
+		return err == nil && uri.IsAbs()
+	}
+	return true
+}
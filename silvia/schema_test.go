@@ -0,0 +1,297 @@
+package silvia
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testSchemas = map[string]string{
+	"ru.qlean/order/jsonschema/1-0-0": `{
+		"self": {"vendor": "ru.qlean", "name": "order", "format": "jsonschema", "version": "1-0-0"},
+		"type": "object",
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"status": {"enum": ["new", "paid"]},
+			"email": {"type": ["string", "null"], "format": "email", "maxLength": 32},
+			"items": {"type": "array", "maxItems": 2, "items": {"type": "string", "pattern": "^[a-z]+$"}}
+		},
+		"required": ["id"],
+		"additionalProperties": false
+	}`,
+	"ru.qlean/order/jsonschema/1-0-1": `{
+		"type": "object",
+		"properties": {
+			"id": {"type": "integer", "minimum": 1, "maximum": 2147483647},
+			"status": {"enum": ["new", "paid"]},
+			"email": {"type": ["string", "null"], "format": "email", "maxLength": 32},
+			"items": {"type": "array", "maxItems": 2, "items": {"type": "string", "pattern": "^[a-z]+$"}},
+			"createdAt": {"type": "string", "format": "date-time"},
+			"address": {
+				"type": "object",
+				"properties": {"city": {"type": "string"}, "geo": {"type": "object", "properties": {"lat": {"type": "number"}}}},
+				"required": ["city"]
+			}
+		},
+		"required": ["id", "address"],
+		"additionalProperties": false
+	}`,
+	"ru.qlean/rating/jsonschema/1-0-0.json": `{
+		"type": "object",
+		"properties": {
+			"rating": {"type": "number", "minimum": 0, "exclusiveMinimum": true, "maximum": 5, "exclusiveMaximum": true, "multipleOf": 0.5},
+			"tags": {"type": "array", "uniqueItems": true},
+			"extra": {"type": "object", "minProperties": 1, "maxProperties": 2}
+		}
+	}`,
+	// Files which aren't schemas are skipped
+	"README.md":                         "# Iglu schemas",
+	".DS_Store":                         "\x00",
+	"ru.qlean/utm/jsonschema/notes.txt": "utm",
+	"ru.qlean/utm/jsonschema/1-0-0": `{
+		"type": "object",
+		"properties": {"utm_source": {"type": "string"}},
+		"additionalProperties": {"type": "string"}
+	}`,
+}
+
+func newTestSchemas(t *testing.T) (*SchemaRegistry, func()) {
+	dir, err := ioutil.TempDir("", "iglu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, schema := range testSchemas {
+		path = filepath.Join(dir, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		err = ioutil.WriteFile(path, []byte(schema), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	registry, err := LoadSchemas(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry, func() { os.RemoveAll(dir) }
+}
+
+func testContexts(contexts ...string) string {
+	data := ""
+	for i, context := range contexts {
+		if i > 0 {
+			data += ","
+		}
+		data += context
+	}
+	return `{"schema":"iglu:com.snowplowanalytics.snowplow/contexts/jsonschema/1-0-1","data":[` + data + `]}`
+}
+
+func testUnstructEvent(event string) string {
+	return `{"schema":"iglu:com.snowplowanalytics.snowplow/unstruct_event/jsonschema/1-0-0","data":` + event + `}`
+}
+
+var schemaResults = []struct {
+	title         string
+	contexts      string
+	unstructEvent string
+	err           string
+}{
+	{`Nothing to validate`, "", "", ""},
+	{
+		`Valid contexts and event`,
+		testContexts(`{"schema":"iglu:ru.qlean/utm/jsonschema/1-0-0","data":{"utm_source":"yandex","utm_term":"cleaning"}}`),
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"id":42,"status":"paid","email":null,"items":["window"]}}`),
+		"",
+	},
+	{
+		`Invalid second context`,
+		testContexts(`{"schema":"iglu:ru.qlean/utm/jsonschema/1-0-0","data":{}}`, `{"schema":"iglu:ru.qlean/utm/jsonschema/1-0-0","data":{"utm_term":1}}`),
+		"",
+		"contexts[1] iglu:ru.qlean/utm/jsonschema/1-0-0: data.utm_term: expected string, got integer",
+	},
+	{
+		`Unknown schema`,
+		testContexts(`{"schema":"iglu:ru.qlean/utm/jsonschema/2-0-0","data":{}}`),
+		"",
+		"contexts[0] iglu:ru.qlean/utm/jsonschema/2-0-0: Unknown schema iglu:ru.qlean/utm/jsonschema/2-0-0",
+	},
+	{
+		`Context without schema`,
+		testContexts(`{"data":{"utm_source":"yandex"}}`),
+		"",
+		`contexts[0]: Invalid schema URI ""`,
+	},
+	{
+		`Contexts of unexpected wrapper`,
+		`{"schema":"iglu:ru.qlean/utm/jsonschema/1-0-0","data":[]}`,
+		"",
+		"contexts iglu:ru.qlean/utm/jsonschema/1-0-0: Expected com.snowplowanalytics.snowplow/contexts schema",
+	},
+	{
+		`Malformed contexts`,
+		`{"schema":`,
+		"",
+		"contexts: unexpected end of JSON input",
+	},
+	{
+		`Required property`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"status":"new"}}`),
+		"unstruct_event iglu:ru.qlean/order/jsonschema/1-0-0: data.id: required",
+	},
+	{
+		`Not allowed property`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"id":1,"price":100}}`),
+		"unstruct_event iglu:ru.qlean/order/jsonschema/1-0-0: data.price: not allowed",
+	},
+	{
+		`Integer`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"id":1.5}}`),
+		"unstruct_event iglu:ru.qlean/order/jsonschema/1-0-0: data.id: expected integer, got number",
+	},
+	{
+		`Minimum`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"id":0}}`),
+		"unstruct_event iglu:ru.qlean/order/jsonschema/1-0-0: data.id: less than 1",
+	},
+	{
+		`Enum`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"id":1,"status":"done"}}`),
+		`unstruct_event iglu:ru.qlean/order/jsonschema/1-0-0: data.status: "done" is not allowed`,
+	},
+	{
+		`Format`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"id":1,"email":"qlean.ru"}}`),
+		`unstruct_event iglu:ru.qlean/order/jsonschema/1-0-0: data.email: invalid email "qlean.ru"`,
+	},
+	{
+		`Items`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"id":1,"items":["window","Oven"]}}`),
+		"unstruct_event iglu:ru.qlean/order/jsonschema/1-0-0: data.items[1]: doesn't match ^[a-z]+$",
+	},
+	{
+		`Max items`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"id":1,"items":["a","b","c"]}}`),
+		"unstruct_event iglu:ru.qlean/order/jsonschema/1-0-0: data.items: more than 2 items",
+	},
+	{
+		`Limits`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/rating/jsonschema/1-0-0","data":{"rating":4.5,"tags":["a","b"],"extra":{"a":1}}}`),
+		"",
+	},
+	{
+		`Exclusive minimum`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/rating/jsonschema/1-0-0","data":{"rating":0}}`),
+		"unstruct_event iglu:ru.qlean/rating/jsonschema/1-0-0: data.rating: not greater than 0",
+	},
+	{
+		`Exclusive maximum`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/rating/jsonschema/1-0-0","data":{"rating":5}}`),
+		"unstruct_event iglu:ru.qlean/rating/jsonschema/1-0-0: data.rating: not less than 5",
+	},
+	{
+		`Multiple of`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/rating/jsonschema/1-0-0","data":{"rating":1.25}}`),
+		"unstruct_event iglu:ru.qlean/rating/jsonschema/1-0-0: data.rating: not a multiple of 0.5",
+	},
+	{
+		`Unique items`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/rating/jsonschema/1-0-0","data":{"tags":["a","b","a"]}}`),
+		"unstruct_event iglu:ru.qlean/rating/jsonschema/1-0-0: data.tags[2]: same as item 0",
+	},
+	{
+		`Min properties`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/rating/jsonschema/1-0-0","data":{"extra":{}}}`),
+		"unstruct_event iglu:ru.qlean/rating/jsonschema/1-0-0: data.extra: fewer than 1 properties",
+	},
+	{
+		`Max properties`,
+		"",
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/rating/jsonschema/1-0-0","data":{"extra":{"a":1,"b":2,"c":3}}}`),
+		"unstruct_event iglu:ru.qlean/rating/jsonschema/1-0-0: data.extra: more than 2 properties",
+	},
+}
+
+func TestValidateSnowplow(t *testing.T) {
+	registry, cleanup := newTestSchemas(t)
+	defer cleanup()
+
+	for _, testCase := range schemaResults {
+		err := registry.ValidateSnowplow(testCase.contexts, testCase.unstructEvent)
+		if err == nil && testCase.err != "" || err != nil && err.Error() != testCase.err {
+			t.Errorf("Failed on: %s\nExpected error %q, got %v", testCase.title, testCase.err, err)
+		}
+	}
+
+	var registryNil *SchemaRegistry
+	if err := registryNil.ValidateSnowplow(`{`, `{`); err != nil {
+		t.Errorf("Nothing must be validated without registry, got %s", err)
+	}
+}
+
+func TestLoadSchemas(t *testing.T) {
+	for _, testCase := range []struct {
+		title  string
+		path   string
+		schema string
+		err    string
+	}{
+		{`Not in repository layout`, "ru.qlean/order/1-0-0.json", `{}`, "expected vendor/name/jsonschema/version file"},
+		{`Self of other schema`, "ru.qlean/order/jsonschema/1-0-1", testSchemas["ru.qlean/order/jsonschema/1-0-0"], "self is iglu:ru.qlean/order/jsonschema/1-0-0"},
+		{`Invalid pattern`, "ru.qlean/order/jsonschema/1-0-0", `{"properties":{"id":{"pattern":"("}}}`, "id: error parsing regexp"},
+		{`Reference`, "ru.qlean/order/jsonschema/1-0-0", `{"properties":{"id":{"$ref":"#/definitions/id"}}}`, "id: unsupported keyword $ref"},
+		{`One of`, "ru.qlean/order/jsonschema/1-0-0", `{"oneOf":[{"type":"string"},{"type":"integer"}]}`, "unsupported keyword oneOf"},
+		{`Any of in items`, "ru.qlean/order/jsonschema/1-0-0", `{"items":{"anyOf":[{"type":"string"}]}}`, "unsupported keyword anyOf"},
+		{`All of`, "ru.qlean/order/jsonschema/1-0-0", `{"allOf":[]}`, "unsupported keyword allOf"},
+		{`Not`, "ru.qlean/order/jsonschema/1-0-0", `{"additionalProperties":{"not":{"type":"null"}}}`, "unsupported keyword not"},
+		{`Pattern properties`, "ru.qlean/order/jsonschema/1-0-0", `{"patternProperties":{"^utm_":{"type":"string"}}}`, "unsupported keyword patternProperties"},
+		{`Dependencies`, "ru.qlean/order/jsonschema/1-0-0", `{"dependencies":{"id":["status"]}}`, "unsupported keyword dependencies"},
+		{`Additional items`, "ru.qlean/order/jsonschema/1-0-0", `{"properties":{"items":{"additionalItems":false}}}`, "items: unsupported keyword additionalItems"},
+		{`Multiple of zero`, "ru.qlean/order/jsonschema/1-0-0", `{"properties":{"id":{"multipleOf":0}}}`, "id: multipleOf 0 is not positive"},
+	} {
+		dir, err := ioutil.TempDir("", "iglu")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, testCase.path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		ioutil.WriteFile(path, []byte(testCase.schema), 0644)
+
+		_, err = LoadSchemas(dir)
+		if err == nil || !strings.Contains(err.Error(), testCase.err) {
+			t.Errorf("Failed on: %s\nSchema must not be loaded, got error %v", testCase.title, err)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestTransformSnowplowSchema(t *testing.T) {
+	registry, cleanup := newTestSchemas(t)
+	defer cleanup()
+
+	request := `{\x22ip_addr\x22:\x22213.24.135.133\x22,\x22time_local\x22:\x2230/Mar/2016:11:46:22 -0400\x22,\x22request_body\x22:{\x22schema\x22:\x22iglu:com.snowplowanalytics.snowplow/payload_data/jsonschema/1-0-2\x22,\x22data\x22:[{\x22e\x22:\x22pv\x22},{\x22e\x22:\x22ue\x22,\x22ue_pr\x22:\x22{\x5C\x22schema\x5C\x22:\x5C\x22iglu:com.snowplowanalytics.snowplow/unstruct_event/jsonschema/1-0-0\x5C\x22,\x5C\x22data\x5C\x22:{\x5C\x22schema\x5C\x22:\x5C\x22iglu:ru.qlean/order/jsonschema/1-0-0\x5C\x22,\x5C\x22data\x5C\x22:{\x5C\x22id\x5C\x22:\x5C\x2242\x5C\x22}}}\x22}]},\x22http_referer\x22:\x22https://qlean.ru/\x22,\x22http_user_agent\x22:\x22Mozilla/5.0\x22}`
+	events, err := TransformSnowplow([]byte(request), nil, registry)
+	expected := "event 1: unstruct_event iglu:ru.qlean/order/jsonschema/1-0-0: data.id: expected integer, got string"
+	if err == nil || err.Error() != expected || len(events) != 1 {
+		t.Fatalf("Expected error %q, got %v", expected, err)
+	}
+	if errType := transformErrorType(err); errType != "Schema" {
+		t.Errorf("Event failed validation must be told from malformed, got %s", errType)
+	}
+}
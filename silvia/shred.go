@@ -0,0 +1,392 @@
+package silvia
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/serenize/snaker"
+)
+
+type (
+	// Shred is a context or unstructured event of Snowplow event, written
+	// to the table of its schema model with id and time of the event
+	Shred struct {
+		Key        SchemaKey
+		Table      *ShredTable
+		RootID     string
+		RootTstamp time.Time
+		Data       map[string]interface{}
+	}
+
+	// ShredTable is a table of schema model, <vendor>_<name>_<model>.
+	// Columns are built from the latest schema of the model, rows of its
+	// older schemas leave added columns empty, so they're all nullable.
+	ShredTable struct {
+		Name    string
+		Columns []ShredColumn
+	}
+
+	// ShredColumn is a property of schema, nested objects are flattened
+	// with their property names joined by underscore
+	ShredColumn struct {
+		Name    string
+		Type    string
+		NotNull bool
+
+		path []string
+		kind string
+	}
+
+	// ShreddedEvent is an event with shreds written along with it
+	ShreddedEvent interface {
+		Event
+		Shredded() []*Shred
+	}
+
+	// shredBatch is rows of a shredded table in a batch of events
+	shredBatch struct {
+		Table *ShredTable
+		Rows  []interface{}
+	}
+
+	// shredDB executes statements and selects columns of shredded tables
+	shredDB interface {
+		execer
+		Select(i interface{}, query string, args ...interface{}) ([]interface{}, error)
+	}
+
+	// shredTables are shredded tables of a sink known to exist with
+	// columns of the latest schema, the lock is held while they're migrated
+	shredTables struct {
+		sync.Mutex
+		created map[string]bool
+	}
+)
+
+// Kinds of column values converted from JSON
+const (
+	shredString    = "string"
+	shredInteger   = "integer"
+	shredNumber    = "number"
+	shredBoolean   = "boolean"
+	shredTimestamp = "timestamp"
+	shredJSON      = "json"
+)
+
+// Columns every shredded table starts with, as in Snowplow shredded tables
+var shredRootColumns = []ShredColumn{
+	{Name: "schema_vendor", Type: "varchar(128)", NotNull: true},
+	{Name: "schema_name", Type: "varchar(128)", NotNull: true},
+	{Name: "schema_format", Type: "varchar(128)", NotNull: true},
+	{Name: "schema_version", Type: "varchar(128)", NotNull: true},
+	{Name: "root_id", Type: "char(36)", NotNull: true},
+	{Name: "root_tstamp", Type: "timestamp", NotNull: true},
+	{Name: "ref_root", Type: "varchar(255)", NotNull: true},
+	{Name: "ref_tree", Type: "varchar(1500)", NotNull: true},
+	{Name: "ref_parent", Type: "varchar(255)", NotNull: true},
+}
+
+// newShredTable builds table of model with the latest schema of it
+func newShredTable(key SchemaKey, schema *Schema) *ShredTable {
+	name := strings.ToLower(strings.NewReplacer(".", "_", "-", "_").Replace(key.Vendor) + "_" + snaker.CamelToSnake(key.Name))
+	return &ShredTable{
+		Name:    name + "_" + strconv.Itoa(key.Model()),
+		Columns: shredColumns(nil, schema),
+	}
+}
+
+// shredColumns returns columns of object properties sorted by name
+func shredColumns(path []string, schema *Schema) []ShredColumn {
+	names := make([]string, 0, len(schema.Properties))
+	for name := range schema.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var columns []ShredColumn
+	for _, name := range names {
+		property := schema.Properties[name]
+		propertyPath := append(path[:len(path):len(path)], name)
+
+		types := property.nonNullTypes()
+		if len(types) == 1 && types[0] == "object" && len(property.Properties) > 0 {
+			columns = append(columns, shredColumns(propertyPath, property)...)
+			continue
+		}
+
+		column := property.shredColumn()
+		parts := make([]string, len(propertyPath))
+		for i, part := range propertyPath {
+			parts[i] = snaker.CamelToSnake(part)
+		}
+		column.Name = strings.Join(parts, "_")
+		column.path = propertyPath
+		columns = append(columns, column)
+	}
+	return columns
+}
+
+func (schema *Schema) nonNullTypes() []string {
+	var types []string
+	for _, schemaType := range schema.Type {
+		if schemaType != "null" {
+			types = append(types, schemaType)
+		}
+	}
+	return types
+}
+
+// shredColumn returns type of column of schema property, values of
+// mixed types, arrays and objects without properties are kept as JSON
+func (schema *Schema) shredColumn() ShredColumn {
+	types := schema.nonNullTypes()
+	if len(schema.Enum) > 0 && len(types) <= 1 {
+		length := 0
+		for _, value := range schema.Enum {
+			value, isString := value.(string)
+			if !isString {
+				length = -1
+				break
+			}
+			if len(value) > length {
+				length = len(value)
+			}
+		}
+		if length > 0 {
+			return ShredColumn{Type: fmt.Sprintf("varchar(%d)", length), kind: shredString}
+		}
+	}
+	if len(types) != 1 {
+		return ShredColumn{Type: "varchar(65535)", kind: shredJSON}
+	}
+
+	switch types[0] {
+	case "string":
+		switch {
+		case schema.Format == "date-time":
+			return ShredColumn{Type: "timestamp", kind: shredTimestamp}
+		case schema.Format == "uuid":
+			return ShredColumn{Type: "char(36)", kind: shredString}
+		case schema.MaxLength != nil && *schema.MaxLength > 0 && *schema.MaxLength <= 65535:
+			if schema.MinLength != nil && *schema.MinLength == *schema.MaxLength {
+				return ShredColumn{Type: fmt.Sprintf("char(%d)", *schema.MaxLength), kind: shredString}
+			}
+			return ShredColumn{Type: fmt.Sprintf("varchar(%d)", *schema.MaxLength), kind: shredString}
+		}
+		return ShredColumn{Type: "varchar(4096)", kind: shredString}
+	case "integer":
+		switch {
+		case schema.Minimum == nil || schema.Maximum == nil:
+			return ShredColumn{Type: "bigint", kind: shredInteger}
+		case *schema.Minimum >= -32768 && *schema.Maximum <= 32767:
+			return ShredColumn{Type: "smallint", kind: shredInteger}
+		case *schema.Minimum >= -2147483648 && *schema.Maximum <= 2147483647:
+			return ShredColumn{Type: "integer", kind: shredInteger}
+		}
+		return ShredColumn{Type: "bigint", kind: shredInteger}
+	case "number":
+		return ShredColumn{Type: "double precision", kind: shredNumber}
+	case "boolean":
+		return ShredColumn{Type: "boolean", kind: shredBoolean}
+	}
+	return ShredColumn{Type: "varchar(65535)", kind: shredJSON}
+}
+
+// ColumnNames returns names of every column of table
+func (table *ShredTable) ColumnNames() []string {
+	var names []string
+	for _, column := range shredRootColumns {
+		names = append(names, column.Name)
+	}
+	for _, column := range table.Columns {
+		names = append(names, column.Name)
+	}
+	return names
+}
+
+// DDL returns statement creating table in schema unless it exists. Redshift
+// tables are distributed by root_id and sorted by root_tstamp, as events.
+func (table *ShredTable) DDL(schema string, redshift bool) string {
+	var ddl strings.Builder
+	fmt.Fprintf(&ddl, "CREATE TABLE IF NOT EXISTS \"%s\".\"%s\" (\n", schema, table.Name)
+	columns := append(shredRootColumns[:len(shredRootColumns):len(shredRootColumns)], table.Columns...)
+	for i, column := range columns {
+		fmt.Fprintf(&ddl, "\t\"%s\" %s", column.Name, column.Type)
+		if column.NotNull {
+			ddl.WriteString(" NOT NULL")
+		}
+		if i < len(columns)-1 {
+			ddl.WriteString(",")
+		}
+		ddl.WriteString("\n")
+	}
+	ddl.WriteString(")")
+	if redshift {
+		ddl.WriteString("\nDISTSTYLE KEY\nDISTKEY (root_id)\nSORTKEY (root_tstamp)")
+	}
+	ddl.WriteString(";")
+	return ddl.String()
+}
+
+// AddColumnsDDL returns statements adding columns missing in the existing
+// table of schema, one per statement as Redshift requires
+func (table *ShredTable) AddColumnsDDL(schema string, existing []string) []string {
+	var statements []string
+	for _, column := range table.Columns {
+		if !inStrings(existing, column.Name) {
+			statements = append(statements, fmt.Sprintf("ALTER TABLE \"%s\".\"%s\" ADD COLUMN \"%s\" %s;", schema, table.Name, column.Name, column.Type))
+		}
+	}
+	return statements
+}
+
+// migrate creates table in schema unless it exists, columns added by newer
+// schemas of the model are added to the existing table
+func (table *ShredTable) migrate(db shredDB, schema string, redshift bool) error {
+	var existing []string
+	_, err := db.Select(&existing, "SELECT column_name FROM information_schema.columns WHERE table_schema = $1 AND table_name = $2", schema, table.Name)
+	if err != nil {
+		return err
+	}
+	if len(existing) == 0 {
+		_, err = db.Exec(table.DDL(schema, redshift))
+		return err
+	}
+	for _, statement := range table.AddColumnsDDL(schema, existing) {
+		_, err = db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Row returns values of shred in the order of ColumnNames
+func (shred *Shred) Row() []interface{} {
+	row := []interface{}{
+		shred.Key.Vendor, shred.Key.Name, shred.Key.Format, shred.Key.Version,
+		shred.RootID, shred.RootTstamp, "events", "events," + shred.Key.Name, "events",
+	}
+	for _, column := range shred.Table.Columns {
+		row = append(row, column.value(shred.Data))
+	}
+	return row
+}
+
+// value converts property of column in data, missing properties are nil
+func (column ShredColumn) value(data map[string]interface{}) interface{} {
+	var value interface{} = data
+	for _, name := range column.path {
+		object, isObject := value.(map[string]interface{})
+		if !isObject {
+			return nil
+		}
+		value = object[name]
+	}
+	if value == nil {
+		return nil
+	}
+
+	switch column.kind {
+	case shredJSON:
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	case shredTimestamp:
+		if value, isString := value.(string); isString {
+			timestamp, err := time.Parse(time.RFC3339Nano, value)
+			if err == nil {
+				return timestamp.UTC()
+			}
+		}
+	case shredInteger:
+		if value, isNumber := value.(float64); isNumber {
+			return int64(value)
+		}
+	}
+	return value
+}
+
+// shredEvents groups shreds of events by their tables, ordered by name
+func shredEvents(events []Event) []*shredBatch {
+	batches := map[string]*shredBatch{}
+	for _, event := range events {
+		shredded, ok := event.(ShreddedEvent)
+		if !ok {
+			continue
+		}
+		for _, shred := range shredded.Shredded() {
+			batch, exist := batches[shred.Table.Name]
+			if !exist {
+				batch = &shredBatch{Table: shred.Table}
+				batches[shred.Table.Name] = batch
+			}
+			batch.Rows = append(batch.Rows, shred.Row())
+		}
+	}
+
+	var names []string
+	for name := range batches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sorted := make([]*shredBatch, len(names))
+	for i, name := range names {
+		sorted[i] = batches[name]
+	}
+	return sorted
+}
+
+// reset forgets created tables, they are checked again after reconnect
+func (tables *shredTables) reset() {
+	tables.Lock()
+	tables.created = map[string]bool{}
+	tables.Unlock()
+}
+
+// migrate creates or migrates shredded tables in schema unless they're
+// known to exist. Statements are committed on their own, before batches
+// are written, and tables are migrated one at a time so run and drain of
+// a sink don't add the same column twice.
+func (tables *shredTables) migrate(db shredDB, schema string, shreds []*shredBatch, redshift bool) error {
+	tables.Lock()
+	defer tables.Unlock()
+	for _, shred := range shreds {
+		if tables.created[shred.Table.Name] {
+			continue
+		}
+		err := shred.Table.migrate(db, schema, redshift)
+		if err != nil {
+			return fmt.Errorf("Can't migrate %s.%s: %s", schema, shred.Table.Name, err)
+		}
+		tables.created[shred.Table.Name] = true
+	}
+	return nil
+}
+
+// writeShreds loads rows of shreds into their tables in schema, they must
+// be migrated before
+func writeShreds(db execer, schema string, shreds []*shredBatch,
+	load func(db execer, schema string, table string, columns []string, rows []interface{}) error) error {
+	for _, shred := range shreds {
+		err := load(db, schema, shred.Table.Name, shred.Table.ColumnNames(), shred.Rows)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %s", schema, shred.Table.Name, err)
+		}
+	}
+	return nil
+}
+
+func inStrings(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
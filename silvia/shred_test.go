@@ -0,0 +1,187 @@
+package silvia
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShredTable(t *testing.T) {
+	registry, cleanup := newTestSchemas(t)
+	defer cleanup()
+
+	key, _ := ParseSchemaKey("iglu:ru.qlean/order/jsonschema/1-0-0")
+	table := registry.tables[key]
+	if table == nil || table.Name != "ru_qlean_order_1" {
+		t.Fatalf("Unexpected table: %+v", table)
+	}
+
+	// Columns of the latest schema of model, nullable as rows of older
+	// schemas may not have required properties of the latest one
+	expected := []ShredColumn{
+		{Name: "address_city", Type: "varchar(4096)"},
+		{Name: "address_geo_lat", Type: "double precision"},
+		{Name: "created_at", Type: "timestamp"},
+		{Name: "email", Type: "varchar(32)"},
+		{Name: "id", Type: "integer"},
+		{Name: "items", Type: "varchar(65535)"},
+		{Name: "status", Type: "varchar(4)"},
+	}
+	if len(table.Columns) != len(expected) {
+		t.Fatalf("Unexpected columns: %+v", table.Columns)
+	}
+	for i, column := range table.Columns {
+		if column.Name != expected[i].Name || column.Type != expected[i].Type || column.NotNull != expected[i].NotNull {
+			t.Errorf("Expected column %+v, got %+v", expected[i], column)
+		}
+	}
+
+	ddl := table.DDL("atomic", false)
+	for _, line := range []string{
+		`CREATE TABLE IF NOT EXISTS "atomic"."ru_qlean_order_1" (`,
+		"\t\"root_id\" char(36) NOT NULL,\n",
+		"\t\"address_city\" varchar(4096),\n",
+		"\t\"id\" integer,\n",
+		"\t\"status\" varchar(4)\n);",
+	} {
+		if !strings.Contains(ddl, line) {
+			t.Errorf("DDL doesn't contain %q:\n%s", line, ddl)
+		}
+	}
+	if ddl := table.DDL("atomic", true); !strings.HasSuffix(ddl, "DISTKEY (root_id)\nSORTKEY (root_tstamp);") {
+		t.Errorf("Redshift table must be distributed by root_id:\n%s", ddl)
+	}
+}
+
+func TestShredTableMigrate(t *testing.T) {
+	registry, cleanup := newTestSchemas(t)
+	defer cleanup()
+
+	key, _ := ParseSchemaKey("iglu:ru.qlean/order/jsonschema/1-0-1")
+	table := registry.tables[key]
+
+	db := &testExecer{}
+	if err := table.migrate(db, "atomic", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.queries) != 2 || db.queries[1] != table.DDL("atomic", true) {
+		t.Errorf("Table which doesn't exist must be created, got %q", db.queries)
+	}
+
+	// Table created by 1-0-0 lacks address and created_at
+	db = &testExecer{columns: []string{"root_id", "root_tstamp", "email", "id", "items", "status"}}
+	if err := table.migrate(db, "atomic", true); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`ALTER TABLE "atomic"."ru_qlean_order_1" ADD COLUMN "address_city" varchar(4096);`,
+		`ALTER TABLE "atomic"."ru_qlean_order_1" ADD COLUMN "address_geo_lat" double precision;`,
+		`ALTER TABLE "atomic"."ru_qlean_order_1" ADD COLUMN "created_at" timestamp;`,
+	}
+	if !reflect.DeepEqual(db.queries[1:], expected) {
+		t.Errorf("Missing columns must be added, got %q", db.queries[1:])
+	}
+
+	db = &testExecer{columns: table.ColumnNames()}
+	if err := table.migrate(db, "atomic", true); err != nil || len(db.queries) != 1 {
+		t.Errorf("Table with every column must be left as is, got %q", db.queries)
+	}
+}
+
+func TestShredTablesMigrate(t *testing.T) {
+	registry, cleanup := newTestSchemas(t)
+	defer cleanup()
+
+	key, _ := ParseSchemaKey("iglu:ru.qlean/order/jsonschema/1-0-1")
+	shreds := []*shredBatch{{Table: registry.tables[key]}}
+	tables := &shredTables{}
+	tables.reset()
+
+	// Run and drain of a sink write batches of the same table at once
+	db := &testExecer{}
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tables.migrate(db, "atomic", shreds, false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(db.queries) != 2 {
+		t.Errorf("Table must be migrated once, got %q", db.queries)
+	}
+
+	tables.reset()
+	db = &testExecer{}
+	if err := tables.migrate(db, "atomic", shreds, false); err != nil || len(db.queries) != 2 {
+		t.Errorf("Table must be migrated again after reset, got %q", db.queries)
+	}
+}
+
+func TestShredSnowplow(t *testing.T) {
+	registry, cleanup := newTestSchemas(t)
+	defer cleanup()
+
+	shreds, err := registry.ShredSnowplow(
+		testContexts(`{"schema":"iglu:ru.qlean/utm/jsonschema/1-0-0","data":{"utm_source":"yandex"}}`),
+		testUnstructEvent(`{"schema":"iglu:ru.qlean/order/jsonschema/1-0-1","data":{"id":42,"items":["window"],"createdAt":"2016-04-15T20:46:55+03:00","address":{"city":"Moscow"}}}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shreds) != 2 || shreds[0].Table.Name != "ru_qlean_utm_1" || shreds[1].Table.Name != "ru_qlean_order_1" {
+		t.Fatalf("Every context and unstructured event must be shredded: %v", shreds)
+	}
+
+	tstamp := time.Date(2016, 4, 15, 17, 46, 55, 0, time.UTC)
+	order := shreds[1]
+	order.RootID = "850ed957-9a2f-49e3-bb46-a33a5769298c"
+	order.RootTstamp = tstamp
+
+	expected := []interface{}{
+		"ru.qlean", "order", "jsonschema", "1-0-1", "850ed957-9a2f-49e3-bb46-a33a5769298c", tstamp, "events", "events,order", "events",
+		"Moscow", nil, tstamp, nil, int64(42), `["window"]`, nil,
+	}
+	row := order.Row()
+	if len(row) != len(order.Table.ColumnNames()) {
+		t.Fatalf("Row must have value of every column: %v", row)
+	}
+	for i, value := range row {
+		if !reflect.DeepEqual(value, expected[i]) {
+			t.Errorf("Unexpected %s: %#v", order.Table.ColumnNames()[i], value)
+		}
+	}
+}
+
+func TestShredEvents(t *testing.T) {
+	registry, cleanup := newTestSchemas(t)
+	defer cleanup()
+
+	utm := testContexts(`{"schema":"iglu:ru.qlean/utm/jsonschema/1-0-0","data":{}}`)
+	order := testUnstructEvent(`{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"id":1}}`)
+
+	var events []Event
+	for _, unstructEvent := range []string{order, "", order} {
+		shreds, err := registry.ShredSnowplow(utm, unstructEvent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, &SnowplowEvent{Shreds: shreds})
+	}
+	events = append(events, &AdjustEvent{})
+
+	batches := shredEvents(events)
+	if len(batches) != 2 || batches[0].Table.Name != "ru_qlean_order_1" || len(batches[0].Rows) != 2 || len(batches[1].Rows) != 3 {
+		t.Errorf("Shreds must be grouped by table: %+v", batches)
+	}
+
+	query, args := batchInsert("atomic", batches[0].Table.Name, batches[0].Table.ColumnNames(), batches[0].Rows)
+	if !strings.HasPrefix(query, `INSERT INTO "atomic"."ru_qlean_order_1" ("schema_vendor", `) || len(args) != 2*len(batches[0].Table.ColumnNames()) {
+		t.Errorf("Unexpected insert of shreds: %s", query)
+	}
+}
@@ -0,0 +1,470 @@
+package silvia
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+type (
+	// Sink is a destination events are written to. Every batch is either
+	// written entirely or reported failed, so its messages get requeued.
+	// Ping reports whether connection is alive, the sink is reconnected
+	// if it's not.
+	Sink interface {
+		Connect(config *Config) error
+		Ping() error
+		Write(table Table, events []Event) error
+		Close() error
+	}
+
+	// SinkDriver creates sinks of a kind and defines their default batching
+	// per tracker, overridden with <name>_<tracker>_batch_* Consul keys.
+	// Batch is used for trackers missing in Batches. Raw sinks keep raw
+	// messages, they get events dropped as duplicates too.
+	SinkDriver struct {
+		New     func() Sink
+		Batch   BatchLimits
+		Batches map[string]BatchLimits
+		Raw     bool
+	}
+
+	// SinkState is a sink enabled in config with its health and buses
+	SinkState struct {
+		Name   string
+		Sink   Sink
+		Health Health
+		Buses  map[string]*SinkBus
+		// Keeps events while the sink is down if spill_dir is set
+		Spill *Spill
+		// Gets every event of a message, see SinkDriver
+		Raw bool
+
+		// Held for writing to connection, exclusively to reconnect
+		conn        sync.RWMutex
+		down        chan struct{}
+		disabled    chan struct{}
+		disableOnce sync.Once
+		// Set once Run is started, guarded by Worker.sinksLock. Stopped is
+		// closed once it returns.
+		started bool
+		stopped chan struct{}
+	}
+
+	// SinkBus carries events of a tracker to a sink. Batch limits can be
+	// changed on config reload, they are read with Limits.
+	SinkBus struct {
+		sync.RWMutex
+		Tracker Tracker
+		Events  chan Event
+		Batch   BatchLimits
+
+		SuccessRing *Ring[Event]
+		FailRing    *Ring[Event]
+
+		closed sync.Once
+	}
+
+	SinkStatus struct {
+		Health   bool
+		Trackers map[string]SinkBusStatus
+		Spill    *SpillStatus `json:",omitempty"`
+	}
+
+	SinkBusStatus struct {
+		Success int
+		Failed  int
+		Batch   BatchStatus
+	}
+)
+
+var (
+	sinkDrivers = map[string]SinkDriver{}
+
+	errSinkDown = errors.New("Sink is down")
+
+	// Reconnect backoff doubles from min to max after every failure
+	sinkMinBackoff   = time.Second
+	sinkMaxBackoff   = time.Minute
+	sinkPingInterval = 10 * time.Second
+	sinkHealthPoll   = 100 * time.Millisecond
+)
+
+// RegisterSink makes sink kind available under name, it's enabled with
+// <name>_enabled Consul key.
+func RegisterSink(name string, driver SinkDriver) {
+	if _, exist := sinkDrivers[name]; exist {
+		panic("Sink already registered: " + name)
+	}
+	sinkDrivers[name] = driver
+}
+
+// newSinks creates states for every registered sink enabled in config,
+// ordered by name, with a bus for every tracker.
+func newSinks(config *Config, trackers []*TrackerState, ringSize int) ([]*SinkState, error) {
+	var names []string
+	for name := range sinkDrivers {
+		if config.Bool(name + "_enabled") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var sinks []*SinkState
+	for _, name := range names {
+		sinks = append(sinks, newSink(name, config, trackers, ringSize))
+	}
+	return sinks, nil
+}
+
+// newSink creates state of the registered sink with a bus for every tracker
+func newSink(name string, config *Config, trackers []*TrackerState, ringSize int) *SinkState {
+	driver := sinkDrivers[name]
+	sink := &SinkState{
+		Name:     name,
+		Sink:     driver.New(),
+		Buses:    map[string]*SinkBus{},
+		Raw:      driver.Raw,
+		down:     make(chan struct{}, 1),
+		disabled: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	for _, tracker := range trackers {
+		trackerName := tracker.Tracker.Name()
+		batch := driver.limits(config, name, trackerName)
+		sink.Buses[trackerName] = &SinkBus{
+			Tracker:     tracker.Tracker,
+			Events:      make(chan Event, batch.MaxRows),
+			Batch:       batch,
+			SuccessRing: NewRing[Event](ringSize),
+			FailRing:    NewRing[Event](ringSize),
+		}
+	}
+	return sink
+}
+
+// limits returns batch limits of tracker in sink name, driver defaults
+// overridden with config
+func (driver SinkDriver) limits(config *Config, name string, tracker string) BatchLimits {
+	defaults, exist := driver.Batches[tracker]
+	if !exist {
+		defaults = driver.Batch
+	}
+
+	prefix := name + "_" + tracker + "_batch_"
+	return batchLimits(config.Int(prefix+"rows"), config.Int(prefix+"bytes"), config.Duration(prefix+"age"), defaults)
+}
+
+// Limits returns current batch limits of the bus
+func (bus *SinkBus) Limits() BatchLimits {
+	bus.RLock()
+	defer bus.RUnlock()
+	return bus.Batch
+}
+
+// SetLimits changes batch limits starting with the next batch
+func (bus *SinkBus) SetLimits(limits BatchLimits) {
+	bus.Lock()
+	bus.Batch = limits
+	bus.Unlock()
+}
+
+// Close closes events channel of the bus, it's safe to call it again
+func (bus *SinkBus) Close() {
+	bus.closed.Do(func() {
+		close(bus.Events)
+	})
+}
+
+func (sink *SinkState) Status() SinkStatus {
+	status := SinkStatus{
+		Health:   sink.Health.Get(),
+		Trackers: map[string]SinkBusStatus{},
+	}
+	if sink.Spill != nil {
+		spill := sink.Spill.Status()
+		status.Spill = &spill
+	}
+	for name, bus := range sink.Buses {
+		status.Trackers[name] = SinkBusStatus{
+			Success: bus.SuccessRing.Total(),
+			Failed:  bus.FailRing.Total(),
+			Batch:   bus.Limits().Status(),
+		}
+	}
+	return status
+}
+
+// Run keeps the sink connected and writes batches from its buses until
+// all of them are closed, then closes the sink. Batches failed while the
+// sink is down are held and written once it's reconnected, or requeued
+// if ctx is done or the sink is disabled first.
+func (sink *SinkState) Run(ctx context.Context, config *Config) {
+	supervised, stopSupervisor := context.WithCancel(ctx)
+	supervisor := make(chan struct{})
+	go func() {
+		defer close(supervisor)
+		sink.supervise(supervised, config)
+	}()
+
+	// Spill is drained until buses are closed, the rest is kept on disk
+	drainer := make(chan struct{})
+	go func() {
+		defer close(drainer)
+		if sink.Spill != nil {
+			sink.drain(supervised)
+		}
+	}()
+
+	var writers sync.WaitGroup
+	for _, bus := range sink.Buses {
+		writers.Add(1)
+		go func(bus *SinkBus) {
+			defer writers.Done()
+			sink.run(ctx, bus)
+		}(bus)
+	}
+	writers.Wait()
+
+	stopSupervisor()
+	<-supervisor
+	<-drainer
+	if sink.Spill != nil {
+		sink.Spill.Close()
+	}
+
+	if !sink.Health.Get() {
+		return
+	}
+	sink.conn.Lock()
+	err := sink.Sink.Close()
+	sink.conn.Unlock()
+	if err != nil {
+		log.Printf("Can't close %s: %s", sink.Name, err)
+	}
+}
+
+// supervise connects the sink with exponential backoff, then pings it
+// every sinkPingInterval and reconnects once it's down
+func (sink *SinkState) supervise(ctx context.Context, config *Config) {
+	backoff := sinkMinBackoff
+	connected := false
+	for {
+		if !connected {
+			sink.conn.Lock()
+			err := sink.Sink.Connect(config)
+			sink.conn.Unlock()
+			if err != nil {
+				log.Printf("Can't connect to %s! Retry after %s: %s", sink.Name, backoff, err)
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+				if backoff > sinkMaxBackoff {
+					backoff = sinkMaxBackoff
+				}
+				continue
+			}
+
+			connected = true
+			backoff = sinkMinBackoff
+			sink.Health.Set(true)
+			log.Printf("Connected to %s", sink.Name)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(sinkPingInterval):
+		case <-sink.down:
+		}
+
+		err := sink.ping()
+		if err == nil {
+			// Write failure of a sink which is up again
+			sink.Health.Set(true)
+			continue
+		}
+		log.Printf("Lost connection to %s: %s", sink.Name, err)
+		sink.Health.Set(false)
+		metrics.SinkReconnects.Inc(sink.Name)
+
+		sink.conn.Lock()
+		sink.Sink.Close()
+		sink.conn.Unlock()
+		connected = false
+	}
+}
+
+func (sink *SinkState) ping() error {
+	sink.conn.RLock()
+	defer sink.conn.RUnlock()
+	return sink.Sink.Ping()
+}
+
+// write writes batch to the sink. Failure of a healthy sink is the batch
+// failure. If the sink is down the batch is held until it's reconnected,
+// errSinkDown is returned if ctx is done or the sink disabled meanwhile.
+func (sink *SinkState) write(ctx context.Context, table Table, batch []Event) error {
+	for {
+		if !sink.waitHealthy(ctx) {
+			return errSinkDown
+		}
+
+		sink.conn.RLock()
+		err := sink.Sink.Write(table, batch)
+		if err == nil {
+			sink.conn.RUnlock()
+			return nil
+		}
+		pingErr := sink.Sink.Ping()
+		sink.conn.RUnlock()
+		if pingErr == nil {
+			return err
+		}
+
+		sink.Health.Set(false)
+		select {
+		case sink.down <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// writeSplit writes batch. Batch failed while the sink is healthy is split
+// in halves down to the rows rejected, which are written as failure rows of
+// their requests instead, so a single bad row doesn't hold the rest. Returns
+// rejected events with their errors. Error is returned if the sink is down
+// or failure rows can't be written either, as in write.
+func (sink *SinkState) writeSplit(ctx context.Context, table Table, batch []Event) (map[Event]error, error) {
+	err := sink.write(ctx, table, batch)
+	if err == nil || err == errSinkDown {
+		return nil, err
+	}
+
+	if len(batch) == 1 {
+		failure := batch[0].Failure("Write", fmt.Errorf("%s: %s", sink.Name, err))
+		failureErr := sink.write(ctx, table, []Event{failure})
+		if failureErr == errSinkDown {
+			return nil, failureErr
+		}
+		if failureErr != nil {
+			return nil, err
+		}
+		return map[Event]error{batch[0]: err}, nil
+	}
+
+	half := len(batch) / 2
+	rejected, err := sink.writeSplit(ctx, table, batch[:half])
+	if err != nil {
+		return nil, err
+	}
+	more, err := sink.writeSplit(ctx, table, batch[half:])
+	if err != nil {
+		return nil, err
+	}
+	if rejected == nil {
+		return more, nil
+	}
+	for event, eventErr := range more {
+		rejected[event] = eventErr
+	}
+	return rejected, nil
+}
+
+// waitHealthy reports whether the sink is healthy, waiting for it unless
+// ctx is done or the sink is disabled
+func (sink *SinkState) waitHealthy(ctx context.Context) bool {
+	for !sink.Health.Get() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-sink.disabled:
+			return false
+		case <-time.After(sinkHealthPoll):
+		}
+	}
+	return true
+}
+
+// Disable stops the sink from taking new events and from waiting for
+// reconnect, it's safe to call it again
+func (sink *SinkState) Disable() {
+	sink.disableOnce.Do(func() {
+		if sink.disabled != nil {
+			close(sink.disabled)
+		}
+	})
+}
+
+func (sink *SinkState) run(ctx context.Context, bus *SinkBus) {
+	for closed := false; !closed; {
+		var batch []Event
+		var deadline <-chan time.Time
+		size := 0
+		limits := bus.Limits()
+	collect:
+		for !limits.Full(len(batch), size) {
+			select {
+			case event, ok := <-bus.Events:
+				if !ok {
+					closed = true
+					break collect
+				}
+				if len(batch) == 0 {
+					deadline = time.After(limits.MaxAge)
+				}
+				batch = append(batch, event)
+				size += eventSize(event)
+			case <-deadline:
+				break collect
+			}
+		}
+
+		if len(batch) == 0 {
+			continue
+		}
+
+		tracker := bus.Tracker.Name()
+		start := time.Now()
+		rejected, err := sink.writeSplit(ctx, bus.Tracker.Table(), batch)
+		metrics.WriteLatency.Since(start, sink.Name, tracker)
+		if err != nil {
+			metrics.WriteFailed.Add(float64(len(batch)), sink.Name, tracker)
+		} else {
+			metrics.WriteFailed.Add(float64(len(rejected)), sink.Name, tracker)
+			metrics.Written.Add(float64(len(batch)-len(rejected)), sink.Name, tracker)
+		}
+
+		// Batches of a sink which is down are requeued, not dead-lettered
+		failure := err
+		if err != nil && err != errSinkDown {
+			failure = &StageError{Stage: StageWrite, Type: "Write", Err: fmt.Errorf("%s: %s", sink.Name, err)}
+		}
+		// Rejected rows are written as failures, their messages are done
+		for _, event := range batch {
+			event.GetDelivery().Done(failure)
+			switch {
+			case err != nil:
+				bus.FailRing.Add(event, err)
+			case rejected[event] != nil:
+				bus.FailRing.Add(event, rejected[event])
+			default:
+				bus.SuccessRing.Add(event, nil)
+			}
+		}
+		if err != nil {
+			log.Printf("Can't write %s batch to %s: %s", tracker, sink.Name, err)
+		}
+		if len(rejected) > 0 {
+			log.Printf("Wrote %d rejected %s rows to %s as failures", len(rejected), tracker, sink.Name)
+		}
+	}
+}
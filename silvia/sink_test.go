@@ -0,0 +1,279 @@
+package silvia
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSink records batches it is given and rows it wrote, fails batches
+// when err is set or they hold a rejected event. First connectErrs connects
+// fail, ping fails when pingErr is set.
+type testSink struct {
+	sync.Mutex
+	err         error
+	rejected    map[Event]bool
+	pingErr     error
+	connectErrs int
+	connects    int
+	batches     map[Table][][]Event
+	rows        []Event
+	closed      bool
+}
+
+func (sink *testSink) Connect(config *Config) error {
+	sink.Lock()
+	defer sink.Unlock()
+	sink.connects++
+	if sink.connects <= sink.connectErrs {
+		return errors.New("connection refused")
+	}
+	return nil
+}
+
+func (sink *testSink) Ping() error {
+	sink.Lock()
+	defer sink.Unlock()
+	return sink.pingErr
+}
+
+// fail sets write and ping errors
+func (sink *testSink) fail(err error) {
+	sink.Lock()
+	sink.err = err
+	sink.pingErr = err
+	sink.Unlock()
+}
+
+func (sink *testSink) written(table Table) int {
+	sink.Lock()
+	defer sink.Unlock()
+	return len(sink.batches[table])
+}
+
+func (sink *testSink) Write(table Table, events []Event) error {
+	sink.Lock()
+	defer sink.Unlock()
+	sink.batches[table] = append(sink.batches[table], events)
+	for _, event := range events {
+		if sink.rejected[event] {
+			return errors.New("value too long")
+		}
+	}
+	if sink.err == nil {
+		sink.rows = append(sink.rows, events...)
+	}
+	return sink.err
+}
+
+func (sink *testSink) Close() error {
+	sink.Lock()
+	sink.closed = true
+	sink.Unlock()
+	return nil
+}
+
+func newTestSinkState(sink Sink, rows int) *SinkState {
+	state := &SinkState{
+		Name:     "test",
+		Sink:     sink,
+		Buses:    map[string]*SinkBus{},
+		down:     make(chan struct{}, 1),
+		disabled: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	for _, tracker := range []Tracker{&AdjustTracker{}, &SnowplowTracker{}} {
+		state.Buses[tracker.Name()] = &SinkBus{
+			Tracker:     tracker,
+			Events:      make(chan Event, 3),
+			Batch:       BatchLimits{MaxRows: rows, MaxBytes: 1 << 20, MaxAge: time.Minute},
+			SuccessRing: NewRing[Event](10),
+			FailRing:    NewRing[Event](10),
+		}
+	}
+	return state
+}
+
+var sinkRunResults = []struct {
+	title  string
+	err    error
+	writes int
+	acked  bool
+	nacked bool
+}{
+	{`Written batch is acknowledged`, nil, 2, true, false},
+	// Each batch is split down to a row, whose failure row fails too
+	{`Failed batch is requeued`, errors.New("connection reset"), 5, false, true},
+}
+
+func TestSinkStateRun(t *testing.T) {
+	for _, testCase := range sinkRunResults {
+		sink := &testSink{err: testCase.err, batches: map[Table][][]Event{}}
+		state := newTestSinkState(sink, 2)
+		adjust := state.Buses["adjust"]
+
+		ack := &testAcknowledger{}
+		for i := 0; i < 3; i++ {
+			delivery := &Delivery{Tag: uint64(i), acknowledger: ack}
+			delivery.Add(1)
+			adjust.Events <- &AdjustEvent{Delivery: delivery}
+		}
+		close(adjust.Events)
+		close(state.Buses["snowplow"].Events)
+
+		state.Run(context.Background(), &Config{})
+
+		batches := sink.batches[Table{Schema: "adjust", Name: "events"}]
+		if len(sink.batches) != 1 || len(batches) != testCase.writes || len(batches[0]) != 2 || len(batches[len(batches)-1]) != 1 {
+			t.Errorf("Failed on: %s\nUnexpected batches: %v", testCase.title, sink.batches)
+		}
+		if (len(ack.acks) == 3) != testCase.acked || (len(ack.nacks) == 3) != testCase.nacked {
+			t.Errorf("Failed on: %s\nAcks: %v\nNacks: %v", testCase.title, ack.acks, ack.nacks)
+		}
+		if !sink.closed {
+			t.Errorf("Failed on: %s\nSink must be closed when buses are drained", testCase.title)
+		}
+		if !state.Health.Get() {
+			t.Errorf("Failed on: %s\nSink must be healthy after connect", testCase.title)
+		}
+	}
+}
+
+func TestSinkStateReject(t *testing.T) {
+	sink := &testSink{rejected: map[Event]bool{}, batches: map[Table][][]Event{}}
+	state := newTestSinkState(sink, 4)
+	adjust := state.Buses["adjust"]
+	adjust.Events = make(chan Event, 4)
+	failed := metrics.WriteFailed.Get("test", "adjust")
+
+	ack := &testAcknowledger{}
+	events := []Event{}
+	for i := 0; i < 4; i++ {
+		delivery := &Delivery{Tag: uint64(i), acknowledger: ack}
+		delivery.Add(1)
+		event := &AdjustEvent{Body: []byte(fmt.Sprintf("GET /?n=%d HTTP/1.1", i)), Delivery: delivery}
+		events = append(events, event)
+		adjust.Events <- event
+	}
+	sink.rejected[events[2]] = true
+	close(adjust.Events)
+	close(state.Buses["snowplow"].Events)
+
+	state.Run(context.Background(), &Config{})
+
+	// Batch is split in halves until the rejected row is found
+	written := sink.rows
+	if len(written) != 4 || written[0] != events[0] || written[1] != events[1] || written[3] != events[3] {
+		t.Errorf("Rows which are not rejected must be written, got: %v", written)
+	}
+	failure, ok := written[2].(*AdjustEvent)
+	if !ok || failure.ErrType.String != "Write" || failure.Delivery != events[2].GetDelivery() ||
+		failure.ErrorEvent.String != fmt.Sprintf("%#v", "GET /?n=2 HTTP/1.1") {
+		t.Errorf("Rejected row must be written as failure row, got: %#v", written[2])
+	}
+	if len(ack.acks) != 4 || len(ack.nacks) != 0 {
+		t.Errorf("Messages of a batch with rejected row must be done, acks: %v, nacks: %v", ack.acks, ack.nacks)
+	}
+	if fails := adjust.FailRing.Display(); adjust.FailRing.Total() != 1 || len(fails.Ring) != 1 || fails.Ring[0].Event != events[2] {
+		t.Errorf("Rejected row must be in fail ring, got: %v", fails)
+	}
+	if delta := metrics.WriteFailed.Get("test", "adjust") - failed; delta != 1 {
+		t.Errorf("Rejected row must be counted as failed write, got %v", delta)
+	}
+}
+
+// fastReconnect shortens sink reconnect timings, returns restore func
+func fastReconnect() func() {
+	minBackoff, maxBackoff, pingInterval, healthPoll := sinkMinBackoff, sinkMaxBackoff, sinkPingInterval, sinkHealthPoll
+	sinkMinBackoff, sinkMaxBackoff, sinkPingInterval, sinkHealthPoll = time.Millisecond, 4*time.Millisecond, 10*time.Millisecond, time.Millisecond
+	return func() {
+		sinkMinBackoff, sinkMaxBackoff, sinkPingInterval, sinkHealthPoll = minBackoff, maxBackoff, pingInterval, healthPoll
+	}
+}
+
+func TestSinkStateReconnect(t *testing.T) {
+	defer fastReconnect()()
+
+	table := Table{Schema: "adjust", Name: "events"}
+	sink := &testSink{connectErrs: 3, batches: map[Table][][]Event{}}
+	sink.fail(errors.New("connection reset"))
+	state := newTestSinkState(sink, 1)
+	adjust := state.Buses["adjust"]
+	reconnects := metrics.SinkReconnects.Get("test")
+
+	done := make(chan struct{})
+	go func() {
+		state.Run(context.Background(), &Config{})
+		close(done)
+	}()
+
+	ack := &testAcknowledger{}
+	delivery := &Delivery{Tag: 1, acknowledger: ack}
+	delivery.Add(1)
+	adjust.Events <- &AdjustEvent{Delivery: delivery}
+
+	// Batch failed while the sink is down is held until it's back
+	for sink.written(table) == 0 || metrics.SinkReconnects.Get("test") == reconnects {
+		time.Sleep(time.Millisecond)
+	}
+	sink.fail(nil)
+	close(adjust.Events)
+	close(state.Buses["snowplow"].Events)
+	<-done
+
+	if len(ack.acks) != 1 || len(ack.nacks) != 0 {
+		t.Errorf("Held batch must be written after reconnect, acks: %v, nacks: %v", ack.acks, ack.nacks)
+	}
+	if written := sink.written(table); written < 2 {
+		t.Errorf("Batch must be written again, got %d writes", written)
+	}
+	if sink.connects < 5 {
+		t.Errorf("Sink must be reconnected after failed connects, got %d connects", sink.connects)
+	}
+}
+
+func TestSinkStateDown(t *testing.T) {
+	defer fastReconnect()()
+
+	sink := &testSink{connectErrs: 1 << 30, batches: map[Table][][]Event{}}
+	state := newTestSinkState(sink, 1)
+	adjust := state.Buses["adjust"]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		state.Run(ctx, &Config{})
+		close(done)
+	}()
+
+	ack := &testAcknowledger{}
+	deadLetters := &testDeadLetters{}
+	delivery := &Delivery{Tag: 1, Redelivered: true, acknowledger: ack, deadLetters: deadLetters}
+	delivery.Add(1)
+	adjust.Events <- &AdjustEvent{Delivery: delivery}
+	close(adjust.Events)
+	close(state.Buses["snowplow"].Events)
+
+	cancel()
+	<-done
+
+	if len(ack.nacks) != 1 || !ack.requeue || len(deadLetters.published) != 0 {
+		t.Errorf("Batch held for sink which is down must be requeued on shutdown")
+	}
+	if sink.written(Table{Schema: "adjust", Name: "events"}) != 0 || sink.closed {
+		t.Errorf("Sink which is down must not be written or closed")
+	}
+}
+
+func TestConfigGet(t *testing.T) {
+	config := &Config{RedshiftAdjustBatchRows: 100}
+	if value := config.Get("redshift_adjust_batch_rows"); value != "100" {
+		t.Errorf("Unexpected value: %q", value)
+	}
+	if value := config.Get("unknown_key"); value != "" {
+		t.Errorf("Unknown key must be empty, got %q", value)
+	}
+}
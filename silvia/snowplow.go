@@ -2,7 +2,12 @@ package silvia
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -12,30 +17,20 @@ import (
 )
 
 type (
-	// database structure
-	SnowplowContextsData struct {
-		Data struct {
-			UtmSource   string `json:"utm_source"`
-			UtmMedium   string `json:"utm_medium"`
-			UtmCampaign string `json:"utm_campaign"`
-			UtmContent  string `json:"utm_content"`
-			UtmTerm     string `json:"utm_term"`
-		}
-	}
-
-	SnowplowContexts struct {
-		Schema string                 `json:"schema"`
-		Data   []SnowplowContextsData `json:"data"`
-	}
-
-	SnowplowContextsJsonField struct {
-		Schema string            `json:"schema"`
-		Data   []json.RawMessage `json:"data"`
+	// snowplowUtm is UTM values of a context carrying them
+	snowplowUtm struct {
+		UtmSource   string `json:"utm_source"`
+		UtmMedium   string `json:"utm_medium"`
+		UtmCampaign string `json:"utm_campaign"`
+		UtmContent  string `json:"utm_content"`
+		UtmTerm     string `json:"utm_term"`
 	}
 
 	SnowplowEvent struct {
 		Body             []byte          `db:"-"`
+		Shreds           []*Shred        `db:"-" json:"-"`
 		Id               int             `db:"-"`
+		Delivery         *Delivery       `db:"-" json:"-"`
 		Aid              sql.NullString  `db:"app_id"`
 		Platform         sql.NullString  `db:"platform"`
 		CollectorTstamp  time.Time       `db:"collector_tstamp"`
@@ -149,6 +144,7 @@ type (
 		EventID         string            `json:"eid"`
 		DvceTstamp      SnowplowTimestamp `json:"dtm"`
 		Contexts        string            `json:"co"`
+		ContextsBase64  string            `json:"cx"`
 		BrView          ScreenResolution  `json:"vp"`
 		Doc             ScreenResolution  `json:"ds"`
 		VisitNum        string            `json:"vid"`
@@ -156,6 +152,7 @@ type (
 		UserFingerprint string            `json:"fp"`
 		UserID          string            `json:"uid"`
 		UnstructEvent   string            `json:"ue_pr"`
+		UnstructBase64  string            `json:"ue_px"`
 		SeCategory      string            `json:"se_ca"`
 		SeAction        string            `json:"se_ac"`
 		SeLabel         string            `json:"se_la"`
@@ -172,15 +169,33 @@ type (
 		time.Time
 	}
 
+	// SnowplowRequest is nginx log line of tracker request. POST requests
+	// carry payloads in body, GET pixel requests in querystring of URI.
 	SnowplowRequest struct {
 		IPAddress   string    `json:"ip_addr"`
 		TimeLocal   NginxTime `json:"time_local"`
+		RequestURI  string    `json:"request_uri"`
 		RequestBody Snowplow  `json:"request_body"`
 		Referer     string    `json:"http_referer"`
 		Useragent   string    `json:"http_user_agent"`
 	}
 )
 
+var errNoSnowplowEvents = errors.New("No events in Snowplow request")
+
+// nginx logs empty body of GET requests as unquoted dash
+var emptyRequestBody = regexp.MustCompile(`"request_body":\s*-\s*([,}])`)
+
+// UnmarshalJSON leaves payloads empty if body is a string, which is the
+// case for requests without body
+func (snowplow *Snowplow) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return nil
+	}
+	type payload Snowplow
+	return json.Unmarshal(b, (*payload)(snowplow))
+}
+
 func (nginxTime *NginxTime) UnmarshalJSON(b []byte) (err error) {
 	if b[0] == '"' && b[len(b)-1] == '"' {
 		b = b[1 : len(b)-1]
@@ -212,6 +227,9 @@ func (res *ScreenResolution) UnmarshalJSON(b []byte) (err error) {
 	}
 
 	s := strings.Split(string(b), "x")
+	if len(s) != 2 {
+		return fmt.Errorf("Invalid resolution %q, expected <width>x<height>", b)
+	}
 
 	if res.Width, err = strconv.Atoi(s[0]); err != nil {
 		if tempWidth, err := strconv.ParseFloat(s[0], 64); err != nil {
@@ -231,31 +249,215 @@ func (res *ScreenResolution) UnmarshalJSON(b []byte) (err error) {
 	return nil
 }
 
+func (event *SnowplowEvent) GetDelivery() *Delivery {
+	return event.Delivery
+}
+
+func (event *SnowplowEvent) SetDelivery(delivery *Delivery) {
+	event.Delivery = delivery
+}
+
+func (event *SnowplowEvent) DedupKey() string {
+	if !event.EventID.Valid {
+		return ""
+	}
+	return event.EventID.String
+}
+
+// Shredded returns contexts and unstructured event of event validated
+// against their schemas
+func (event *SnowplowEvent) Shredded() []*Shred {
+	return event.Shreds
+}
+
+func (event *SnowplowEvent) SetError(errType string, err error, raw []byte) {
+	event.Shreds = nil
+	checkStringForNull("error", &event.EventID)
+	checkStringForNull(errType, &event.ErrType)
+	checkStringForNull(err.Error(), &event.Error)
+	checkStringForNull(fmt.Sprintf("%#v", string(raw)), &event.ErrorEvent)
+}
+
+func (event *SnowplowEvent) Failure(errType string, err error) Event {
+	failure := &SnowplowEvent{Body: event.Body, Delivery: event.Delivery}
+	failure.SetError(errType, err, event.Body)
+	return failure
+}
+
+// Transform fills event from request with a single payload, requests with
+// several payloads are split by TransformSnowplow
 func (event *SnowplowEvent) Transform(request []byte, geo *geoip.GeoIP) error {
 	event.Body = request
 
-	normString, err := strconv.Unquote(`"` + string(request) + `"`)
+	snowplowRequest, err := parseSnowplowRequest(request)
 	if err != nil {
 		return err
 	}
+	if len(snowplowRequest.RequestBody.Data) != 1 {
+		return fmt.Errorf("Expected single event in Snowplow request, got %d", len(snowplowRequest.RequestBody.Data))
+	}
+	return event.bind(snowplowRequest, &snowplowRequest.RequestBody.Data[0], geo, nil)
+}
+
+// TransformSnowplow returns event for every payload of request, contexts
+// and unstructured events are validated against schemas unless they are
+// nil. Request fails as a whole, on error the only event returned is its
+// failure.
+func TransformSnowplow(request []byte, geo *geoip.GeoIP, schemas *SchemaRegistry) ([]*SnowplowEvent, error) {
+	snowplowRequest, err := parseSnowplowRequest(request)
+	if err == nil && len(snowplowRequest.RequestBody.Data) == 0 {
+		err = errNoSnowplowEvents
+	}
+	if err != nil {
+		return []*SnowplowEvent{{Body: request}}, err
+	}
+
+	events := make([]*SnowplowEvent, len(snowplowRequest.RequestBody.Data))
+	for i := range snowplowRequest.RequestBody.Data {
+		event := &SnowplowEvent{Body: request}
+		err := event.bind(snowplowRequest, &snowplowRequest.RequestBody.Data[i], geo, schemas)
+		if err != nil {
+			return []*SnowplowEvent{event}, fmt.Errorf("event %d: %w", i, err)
+		}
+		events[i] = event
+	}
+	return events, nil
+}
+
+// parseSnowplowRequest decodes nginx log line, payloads of GET requests
+// are mapped from querystring with the same fields as POST body
+func parseSnowplowRequest(request []byte) (snowplowRequest *SnowplowRequest, err error) {
+	defer recoverTransform(&err)
+	normString, err := strconv.Unquote(`"` + string(request) + `"`)
+	if err != nil {
+		return nil, err
+	}
 
 	normString = strings.Replace(normString, "\" ", "", -1)
+	normString = emptyRequestBody.ReplaceAllString(normString, `"request_body":null$1`)
 
-	snowplowRequest := &SnowplowRequest{}
+	snowplowRequest = &SnowplowRequest{}
 	err = json.Unmarshal([]byte(normString), snowplowRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(snowplowRequest.RequestBody.Data) > 0 || snowplowRequest.RequestURI == "" {
+		return snowplowRequest, nil
+	}
+
+	uri, err := url.ParseRequestURI(snowplowRequest.RequestURI)
+	if err != nil {
+		return nil, err
+	}
+	query := uri.Query()
+	if query.Get("e") == "" {
+		return snowplowRequest, nil
+	}
+
+	// Querystring is mapped through JSON, so GET and POST share decoding
+	payload := map[string]string{}
+	for key, values := range query {
+		payload[key] = values[0]
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	snowplowData := SnowplowData{}
+	err = json.Unmarshal(data, &snowplowData)
+	if err != nil {
+		return nil, err
+	}
+	snowplowRequest.RequestBody.Data = []SnowplowData{snowplowData}
+	return snowplowRequest, nil
+}
+
+// decodeBase64 fills contexts and unstructured event from their base64
+// encoded variants, which trackers send by default
+func (snowplowData *SnowplowData) decodeBase64() error {
+	var err error
+	if snowplowData.Contexts == "" && snowplowData.ContextsBase64 != "" {
+		snowplowData.Contexts, err = decodeSnowplowBase64(snowplowData.ContextsBase64)
+		if err != nil {
+			return fmt.Errorf("cx: %s", err)
+		}
+	}
+	if snowplowData.UnstructEvent == "" && snowplowData.UnstructBase64 != "" {
+		snowplowData.UnstructEvent, err = decodeSnowplowBase64(snowplowData.UnstructBase64)
+		if err != nil {
+			return fmt.Errorf("ue_px: %s", err)
+		}
+	}
+	return nil
+}
+
+// bindContexts keeps data of the first context and takes UTM values from
+// the first context carrying them. Contexts which aren't self-describing, as
+// of old mobile trackers, are their data, items which aren't objects are
+// skipped.
+func (event *SnowplowEvent) bindContexts(raw string) error {
+	wrapper := SelfDescribing{}
+	err := json.Unmarshal([]byte(raw), &wrapper)
 	if err != nil {
 		return err
 	}
+	var items []json.RawMessage
+	if len(wrapper.Data) > 0 {
+		err = json.Unmarshal(wrapper.Data, &items)
+		if err != nil {
+			return err
+		}
+	}
+
+	var contexts []SelfDescribing
+	for _, item := range items {
+		context := SelfDescribing{}
+		if json.Unmarshal(item, &context) != nil {
+			metrics.SkippedContexts.Inc()
+			continue
+		}
+		if context.Schema == "" && context.Data == nil {
+			context.Data = item
+		}
+		contexts = append(contexts, context)
+	}
+	if len(contexts) == 0 {
+		return nil
+	}
+	checkStringForNull(string(contexts[0].Data), &event.Contexts)
+
+	for _, context := range contexts {
+		utm := snowplowUtm{}
+		err := json.Unmarshal(context.Data, &utm)
+		if err != nil || utm == (snowplowUtm{}) {
+			continue
+		}
+		checkStringForNull(utm.UtmCampaign, &event.UtmCampaign)
+		checkStringForNull(utm.UtmContent, &event.UtmContent)
+		checkStringForNull(utm.UtmTerm, &event.UtmTerm)
+		checkStringForNull(utm.UtmSource, &event.UtmSource)
+		checkStringForNull(utm.UtmMedium, &event.UtmMedium)
+		break
+	}
+	return nil
+}
 
+// decodeSnowplowBase64 decodes URL-safe base64, padding is optional
+func decodeSnowplowBase64(value string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	return string(data), err
+}
+
+// bind maps payload of request to event
+func (event *SnowplowEvent) bind(snowplowRequest *SnowplowRequest, snowplowData *SnowplowData, geo *geoip.GeoIP, schemas *SchemaRegistry) (err error) {
+	defer recoverTransform(&err)
 	// Binding first level nginx fields
 	checkStringForNull(snowplowRequest.IPAddress, &event.UserIP)
 	event.CollectorTstamp = time.Now().UTC()
 	// checkStringForNull(snowplowRequest.Referer, &event.PageReferrer)
 	checkStringForNull(snowplowRequest.Useragent, &event.Useragent)
 
-	// Binding snowplow data
-	snowplowData := snowplowRequest.RequestBody.Data[0]
-
 	// Bind string values
 	checkStringForNull(snowplowData.Event, &event.Event)
 	checkStringForNull(snowplowData.PageURL, &event.PageURL)
@@ -306,8 +508,11 @@ func (event *SnowplowEvent) Transform(request []byte, geo *geoip.GeoIP) error {
 	// Bind time values
 	event.DvceTstamp = snowplowData.DvceTstamp.Time
 
-	// Bind Geo values
-	geoIPRecord := geo.GetRecord(snowplowRequest.IPAddress)
+	// Bind Geo values, geo database is optional
+	var geoIPRecord *geoip.GeoIPRecord
+	if geo != nil {
+		geoIPRecord = geo.GetRecord(snowplowRequest.IPAddress)
+	}
 	if geoIPRecord != nil {
 		checkStringForNull(geoIPRecord.CountryName, &event.GeoCountry)
 		checkStringForNull(geoIPRecord.Region, &event.GeoRegion)
@@ -333,40 +538,21 @@ func (event *SnowplowEvent) Transform(request []byte, geo *geoip.GeoIP) error {
 	checkStringForNull(name, &event.BrName)
 	checkStringForNull(version, &event.BrVersion)
 
+	err = snowplowData.decodeBase64()
+	if err != nil {
+		return err
+	}
+	shreds, err := schemas.ShredSnowplow(snowplowData.Contexts, snowplowData.UnstructEvent)
+	if err != nil {
+		return err
+	}
+
 	// Bind contexts
 	if len(snowplowData.Contexts) > 0 {
-		contextsField := &SnowplowContextsJsonField{}
-		err := json.Unmarshal([]byte(snowplowData.Contexts), &contextsField)
-		if err != nil {
-			return err
-		} else {
-			rawContexts := contextsField.Data[0]
-			rawContexts = rawContexts[8 : len(rawContexts)-1]
-
-			// is json?
-			var js interface{}
-			err := json.Unmarshal([]byte(rawContexts), &js)
-			if err != nil {
-				rawContexts = contextsField.Data[0]
-			}
-
-			checkStringForNull(string(rawContexts), &event.Contexts)
-		}
-
-		contexts := &SnowplowContexts{}
-		err = json.Unmarshal([]byte(snowplowData.Contexts), &contexts)
+		err := event.bindContexts(snowplowData.Contexts)
 		if err != nil {
-			return err
-		} else {
-			contextsData := contexts.Data[0].Data
-			checkStringForNull(contextsData.UtmCampaign, &event.UtmCampaign)
-			checkStringForNull(contextsData.UtmContent, &event.UtmContent)
-			checkStringForNull(contextsData.UtmTerm, &event.UtmTerm)
-			checkStringForNull(contextsData.UtmSource, &event.UtmSource)
-			checkStringForNull(contextsData.UtmMedium, &event.UtmMedium)
+			return fmt.Errorf("contexts: %s", err)
 		}
-	} else {
-		event.Contexts.Valid = false
 	}
 
 	// Bind unstructured event
@@ -374,5 +560,13 @@ func (event *SnowplowEvent) Transform(request []byte, geo *geoip.GeoIP) error {
 		checkStringForNull(snowplowData.UnstructEvent, &event.UnstructEvent)
 	}
 
+	// Shreds are written only with id of event to join them on
+	if event.EventID.Valid {
+		for _, shred := range shreds {
+			shred.RootID = event.EventID.String
+			shred.RootTstamp = event.CollectorTstamp
+		}
+		event.Shreds = shreds
+	}
 	return nil
 }
@@ -3,7 +3,9 @@ package silvia
 import (
 	"database/sql"
 	"fmt"
+	"net/url"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -905,6 +907,261 @@ func TestSnowplowTransform(t *testing.T) {
 	}
 }
 
+var transformSnowplowResults = []struct {
+	title   string
+	request string
+	events  []string
+	err     string
+}{
+	{
+		`Every payload of POST is an event`,
+		`{\x22ip_addr\x22:\x22213.24.135.133\x22,\x22time_local\x22:\x2230/Mar/2016:11:46:22 -0400\x22,\x22request_body\x22:{\x22schema\x22:\x22iglu:com.snowplowanalytics.snowplow/payload_data/jsonschema/1-0-2\x22,\x22data\x22:[{\x22e\x22:\x22pv\x22,\x22url\x22:\x22https://qlean.ru/\x22,\x22eid\x22:\x22850ed957-9a2f-49e3-bb46-a33a5769298c\x22,\x22dtm\x22:\x221459352780283\x22,\x22res\x22:\x221600x900\x22},{\x22e\x22:\x22se\x22,\x22url\x22:\x22https://qlean.ru/\x22,\x22eid\x22:\x2201b8fa4f-4a35-4c3a-9e1c-8a3c0b4a62c5\x22,\x22dtm\x22:\x221459352781283\x22,\x22se_ca\x22:\x22order\x22}]},\x22http_referer\x22:\x22https://qlean.ru/\x22,\x22http_user_agent\x22:\x22Mozilla/5.0\x22}`,
+		[]string{"850ed957-9a2f-49e3-bb46-a33a5769298c", "01b8fa4f-4a35-4c3a-9e1c-8a3c0b4a62c5"},
+		"",
+	},
+	{
+		`GET pixel querystring`,
+		`{\x22ip_addr\x22:\x22213.24.135.133\x22,\x22time_local\x22:\x2230/Mar/2016:11:46:22 -0400\x22,\x22request_uri\x22:\x22/i?e=pv&url=https%3A%2F%2Fqlean.ru%2F&eid=850ed957-9a2f-49e3-bb46-a33a5769298c&dtm=1459352780283&res=1600x900&f_pdf=1\x22,\x22request_body\x22:-,\x22http_referer\x22:\x22https://qlean.ru/\x22,\x22http_user_agent\x22:\x22Mozilla/5.0\x22}`,
+		[]string{"850ed957-9a2f-49e3-bb46-a33a5769298c"},
+		"",
+	},
+	{
+		`Empty payloads`,
+		`{\x22ip_addr\x22:\x22213.24.135.133\x22,\x22time_local\x22:\x2230/Mar/2016:11:46:22 -0400\x22,\x22request_body\x22:{\x22schema\x22:\x22iglu:com.snowplowanalytics.snowplow/payload_data/jsonschema/1-0-2\x22,\x22data\x22:[]},\x22http_referer\x22:\x22https://qlean.ru/\x22,\x22http_user_agent\x22:\x22Mozilla/5.0\x22}`,
+		nil,
+		errNoSnowplowEvents.Error(),
+	},
+	{
+		`GET without event`,
+		`{\x22ip_addr\x22:\x22213.24.135.133\x22,\x22time_local\x22:\x2230/Mar/2016:11:46:22 -0400\x22,\x22request_uri\x22:\x22/i?url=https%3A%2F%2Fqlean.ru%2F\x22,\x22request_body\x22:-,\x22http_referer\x22:\x22https://qlean.ru/\x22,\x22http_user_agent\x22:\x22Mozilla/5.0\x22}`,
+		nil,
+		errNoSnowplowEvents.Error(),
+	},
+	{
+		`Invalid payload fails request`,
+		`{\x22ip_addr\x22:\x22213.24.135.133\x22,\x22time_local\x22:\x2230/Mar/2016:11:46:22 -0400\x22,\x22request_body\x22:{\x22schema\x22:\x22iglu:com.snowplowanalytics.snowplow/payload_data/jsonschema/1-0-2\x22,\x22data\x22:[{\x22e\x22:\x22pv\x22,\x22eid\x22:\x22850ed957-9a2f-49e3-bb46-a33a5769298c\x22},{\x22e\x22:\x22pv\x22,\x22co\x22:\x22{\x22}]},\x22http_referer\x22:\x22https://qlean.ru/\x22,\x22http_user_agent\x22:\x22Mozilla/5.0\x22}`,
+		nil,
+		"event 1: contexts: unexpected end of JSON input",
+	},
+}
+
+func TestTransformSnowplow(t *testing.T) {
+	for _, testCase := range transformSnowplowResults {
+		events, err := TransformSnowplow([]byte(testCase.request), nil, nil)
+		if testCase.err != "" {
+			if err == nil || err.Error() != testCase.err || len(events) != 1 {
+				t.Errorf("Failed on: %s\nExpected error %q, got %v", testCase.title, testCase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed on: %s\nError: %s", testCase.title, err)
+			continue
+		}
+
+		if len(events) != len(testCase.events) {
+			t.Errorf("Failed on: %s\nEvents: %d", testCase.title, len(events))
+			continue
+		}
+		for i, event := range events {
+			if event.EventID.String != testCase.events[i] {
+				t.Errorf("Failed on: %s\nEventID: %q", testCase.title, event.EventID.String)
+			}
+			if event.UserIP.String != "213.24.135.133" || event.PageURL.String != "https://qlean.ru/" {
+				t.Errorf("Failed on: %s\nRequest fields must be shared by events: %+v", testCase.title, event)
+			}
+			if event.DvceTstamp.IsZero() || event.DvceScreenWidth != 1600 && event.Event.String == "pv" {
+				t.Errorf("Failed on: %s\nPayload fields must be decoded: %+v", testCase.title, event)
+			}
+		}
+	}
+}
+
+var snowplowBase64Results = []struct {
+	title         string
+	request       string
+	utmSource     string
+	unstructEvent string
+	err           string
+}{
+	{
+		`Encoded contexts and unstructured event in POST`,
+		`{\x22ip_addr\x22:\x22213.24.135.133\x22,\x22time_local\x22:\x2230/Mar/2016:11:46:22 -0400\x22,\x22request_body\x22:{\x22schema\x22:\x22iglu:com.snowplowanalytics.snowplow/payload_data/jsonschema/1-0-2\x22,\x22data\x22:[{\x22e\x22:\x22ue\x22,\x22eid\x22:\x22850ed957-9a2f-49e3-bb46-a33a5769298c\x22,\x22cx\x22:\x22eyJzY2hlbWEiOiJpZ2x1OmNvbS5zbm93cGxvd2FuYWx5dGljcy5zbm93cGxvdy9jb250ZXh0cy9qc29uc2NoZW1hLzEtMC0wIiwiZGF0YSI6W3siZGF0YSI6eyJ1dG1fc291cmNlIjoieWFuZGV4IiwidXRtX21lZGl1bSI6ImNwYyIsInV0bV9jYW1wYWlnbiI6ImJyYW5kIiwidXRtX2NvbnRlbnQiOiJhZDEiLCJ1dG1fdGVybSI6bnVsbH19XX0\x22,\x22ue_px\x22:\x22eyJzY2hlbWEiOiJpZ2x1OmNvbS5zbm93cGxvd2FuYWx5dGljcy5zbm93cGxvdy91bnN0cnVjdF9ldmVudC9qc29uc2NoZW1hLzEtMC0wIiwiZGF0YSI6eyJzY2hlbWEiOiJpZ2x1OnJ1LnFsZWFuL29yZGVyL2pzb25zY2hlbWEvMS0wLTAiLCJkYXRhIjp7ImlkIjo0Mn19fQ==\x22}]},\x22http_referer\x22:\x22https://qlean.ru/\x22,\x22http_user_agent\x22:\x22Mozilla/5.0\x22}`,
+		"yandex",
+		`{"schema":"iglu:com.snowplowanalytics.snowplow/unstruct_event/jsonschema/1-0-0","data":{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"id":42}}}`,
+		"",
+	},
+	{
+		`Encoded contexts and unstructured event in GET`,
+		`{\x22ip_addr\x22:\x22213.24.135.133\x22,\x22time_local\x22:\x2230/Mar/2016:11:46:22 -0400\x22,\x22request_uri\x22:\x22/i?e=ue&eid=850ed957-9a2f-49e3-bb46-a33a5769298c&cx=eyJzY2hlbWEiOiJpZ2x1OmNvbS5zbm93cGxvd2FuYWx5dGljcy5zbm93cGxvdy9jb250ZXh0cy9qc29uc2NoZW1hLzEtMC0wIiwiZGF0YSI6W3siZGF0YSI6eyJ1dG1fc291cmNlIjoieWFuZGV4IiwidXRtX21lZGl1bSI6ImNwYyIsInV0bV9jYW1wYWlnbiI6ImJyYW5kIiwidXRtX2NvbnRlbnQiOiJhZDEiLCJ1dG1fdGVybSI6bnVsbH19XX0&ue_px=eyJzY2hlbWEiOiJpZ2x1OmNvbS5zbm93cGxvd2FuYWx5dGljcy5zbm93cGxvdy91bnN0cnVjdF9ldmVudC9qc29uc2NoZW1hLzEtMC0wIiwiZGF0YSI6eyJzY2hlbWEiOiJpZ2x1OnJ1LnFsZWFuL29yZGVyL2pzb25zY2hlbWEvMS0wLTAiLCJkYXRhIjp7ImlkIjo0Mn19fQ%3D%3D\x22,\x22request_body\x22:-,\x22http_referer\x22:\x22https://qlean.ru/\x22,\x22http_user_agent\x22:\x22Mozilla/5.0\x22}`,
+		"yandex",
+		`{"schema":"iglu:com.snowplowanalytics.snowplow/unstruct_event/jsonschema/1-0-0","data":{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"id":42}}}`,
+		"",
+	},
+	{
+		`Plain variants are preferred`,
+		`{\x22ip_addr\x22:\x22213.24.135.133\x22,\x22time_local\x22:\x2230/Mar/2016:11:46:22 -0400\x22,\x22request_body\x22:{\x22schema\x22:\x22iglu:com.snowplowanalytics.snowplow/payload_data/jsonschema/1-0-2\x22,\x22data\x22:[{\x22e\x22:\x22ue\x22,\x22eid\x22:\x22850ed957-9a2f-49e3-bb46-a33a5769298c\x22,\x22ue_pr\x22:\x22{}\x22,\x22ue_px\x22:\x22eyJzY2hlbWEiOiJpZ2x1OmNvbS5zbm93cGxvd2FuYWx5dGljcy5zbm93cGxvdy91bnN0cnVjdF9ldmVudC9qc29uc2NoZW1hLzEtMC0wIiwiZGF0YSI6eyJzY2hlbWEiOiJpZ2x1OnJ1LnFsZWFuL29yZGVyL2pzb25zY2hlbWEvMS0wLTAiLCJkYXRhIjp7ImlkIjo0Mn19fQ\x22}]},\x22http_referer\x22:\x22https://qlean.ru/\x22,\x22http_user_agent\x22:\x22Mozilla/5.0\x22}`,
+		"",
+		`{}`,
+		"",
+	},
+	{
+		`Invalid encoded contexts`,
+		`{\x22ip_addr\x22:\x22213.24.135.133\x22,\x22time_local\x22:\x2230/Mar/2016:11:46:22 -0400\x22,\x22request_body\x22:{\x22schema\x22:\x22iglu:com.snowplowanalytics.snowplow/payload_data/jsonschema/1-0-2\x22,\x22data\x22:[{\x22e\x22:\x22ue\x22,\x22eid\x22:\x22850ed957-9a2f-49e3-bb46-a33a5769298c\x22,\x22cx\x22:\x22e30+\x22}]},\x22http_referer\x22:\x22https://qlean.ru/\x22,\x22http_user_agent\x22:\x22Mozilla/5.0\x22}`,
+		"",
+		"",
+		"cx: illegal base64 data at input byte 3",
+	},
+}
+
+func TestSnowplowBase64(t *testing.T) {
+	for _, testCase := range snowplowBase64Results {
+		event := &SnowplowEvent{}
+		err := event.Transform([]byte(testCase.request), nil)
+		if testCase.err != "" {
+			if err == nil || err.Error() != testCase.err {
+				t.Errorf("Failed on: %s\nExpected error %q, got %v", testCase.title, testCase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed on: %s\nError: %s", testCase.title, err)
+			continue
+		}
+
+		if event.UtmSource.String != testCase.utmSource || event.Contexts.Valid != (testCase.utmSource != "") {
+			t.Errorf("Failed on: %s\nContexts: %+v, UtmSource: %q", testCase.title, event.Contexts, event.UtmSource.String)
+		}
+		if event.UnstructEvent.String != testCase.unstructEvent {
+			t.Errorf("Failed on: %s\nUnstructEvent: %q", testCase.title, event.UnstructEvent.String)
+		}
+	}
+}
+
+// snowplowContextsRequest returns GET pixel request with plain contexts
+func snowplowContextsRequest(contexts string) string {
+	return `{\x22ip_addr\x22:\x22213.24.135.133\x22,\x22time_local\x22:\x2230/Mar/2016:11:46:22 -0400\x22,\x22request_uri\x22:\x22/i?e=pv&eid=850ed957-9a2f-49e3-bb46-a33a5769298c&co=` +
+		url.QueryEscape(contexts) + `\x22,\x22request_body\x22:-,\x22http_referer\x22:\x22https://qlean.ru/\x22,\x22http_user_agent\x22:\x22Mozilla/5.0\x22}`
+}
+
+var snowplowContextsResults = []struct {
+	title     string
+	contexts  string
+	stored    string
+	utmSource string
+	utmTerm   string
+	err       string
+}{
+	{
+		`Single context`,
+		testContexts(`{"data":{"utm_source":"yandex","utm_term":null}}`),
+		`{"utm_source":"yandex","utm_term":null}`,
+		"yandex", "", "",
+	},
+	{
+		`UTM in the second context`,
+		testContexts(
+			`{"schema":"iglu:ru.qlean/order/jsonschema/1-0-0","data":{"id":42}}`,
+			`{"schema":"iglu:ru.qlean/utm/jsonschema/1-0-0","data":{"utm_source":"yandex","utm_term":"cleaning"}}`,
+		),
+		`{"id":42}`,
+		"yandex", "cleaning", "",
+	},
+	{
+		`UTM of the first context carrying it`,
+		testContexts(`{"data":{"utm_source":"yandex"}}`, `{"data":{"utm_source":"google","utm_term":"cleaning"}}`),
+		`{"utm_source":"yandex"}`,
+		"yandex", "", "",
+	},
+	{
+		`Contexts of other types`,
+		testContexts(`{"data":null}`, `{"data":[1]}`, `{"data":{"utm_source":1}}`),
+		`null`,
+		"", "", "",
+	},
+	{`Empty contexts`, testContexts(), "", "", "", ""},
+	{`Empty context`, testContexts(`{}`), "{}", "", "", ""},
+	{
+		`Context which isn't an object`,
+		testContexts(`"utm_source=yandex"`, `{"data":{"utm_source":"google"}}`),
+		`{"utm_source":"google"}`,
+		"google", "", "",
+	},
+	{
+		`Context which isn't self-describing`,
+		testContexts(`{"utm_source":"yandex","platformDict":{"osType":"ios"}}`, `{"schema":"iglu:com.snowplowanalytics.snowplow/mobile_context/jsonschema/1-0-1","data":{"osType":"ios"}}`),
+		`{"utm_source":"yandex","platformDict":{"osType":"ios"}}`,
+		"yandex", "", "",
+	},
+	{`Contexts without data`, `{"schema":"iglu:com.snowplowanalytics.snowplow/contexts/jsonschema/1-0-1"}`, "", "", "", ""},
+	{
+		`Contexts not a list`,
+		`{"schema":"iglu:com.snowplowanalytics.snowplow/contexts/jsonschema/1-0-1","data":{}}`,
+		"", "", "",
+		"contexts: json: cannot unmarshal object",
+	},
+	{`Invalid contexts`, `{"data":[`, "", "", "", "contexts: unexpected end of JSON input"},
+}
+
+func TestSnowplowContexts(t *testing.T) {
+	skipped := metrics.SkippedContexts.Get()
+	for _, testCase := range snowplowContextsResults {
+		event := &SnowplowEvent{}
+		err := event.Transform([]byte(snowplowContextsRequest(testCase.contexts)), nil)
+		if testCase.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), testCase.err) {
+				t.Errorf("Failed on: %s\nExpected error %q, got %v", testCase.title, testCase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Failed on: %s\nError: %s", testCase.title, err)
+			continue
+		}
+
+		if event.Contexts.String != testCase.stored || event.Contexts.Valid != (testCase.stored != "") {
+			t.Errorf("Failed on: %s\nContexts: %+v", testCase.title, event.Contexts)
+		}
+		if event.UtmSource.String != testCase.utmSource || event.UtmTerm.String != testCase.utmTerm {
+			t.Errorf("Failed on: %s\nUtmSource: %q, UtmTerm: %q", testCase.title, event.UtmSource.String, event.UtmTerm.String)
+		}
+	}
+	// Only the context which isn't an object is skipped
+	if delta := metrics.SkippedContexts.Get() - skipped; delta != 1 {
+		t.Errorf("Skipped contexts must be counted, got %v", delta)
+	}
+}
+
+var screenResolutionResults = []struct {
+	title  string
+	value  string
+	width  int
+	height int
+	err    string
+}{
+	{`Resolution`, `"1600x900"`, 1600, 900, ""},
+	{`Fractional resolution`, `"1600.5x900.5"`, 1600, 900, ""},
+	{`Width only`, `"1600"`, 0, 0, `Invalid resolution "1600", expected <width>x<height>`},
+	{`Number`, `0`, 0, 0, `Invalid resolution "0", expected <width>x<height>`},
+	{`Empty`, `""`, 0, 0, `Invalid resolution "", expected <width>x<height>`},
+}
+
+func TestScreenResolution(t *testing.T) {
+	for _, testCase := range screenResolutionResults {
+		res := ScreenResolution{}
+		err := res.UnmarshalJSON([]byte(testCase.value))
+		if testCase.err != "" {
+			if err == nil || err.Error() != testCase.err {
+				t.Errorf("Failed on: %s\nExpected error %q, got %v", testCase.title, testCase.err, err)
+			}
+			continue
+		}
+		if err != nil || res.Width != testCase.width || res.Height != testCase.height {
+			t.Errorf("Failed on: %s\nResolution: %+v, error: %v", testCase.title, res, err)
+		}
+	}
+}
+
 func PrintSnowplow(t *testing.T) {
 	var GeoDB *geoip.GeoIP
 	var err error
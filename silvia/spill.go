@@ -0,0 +1,498 @@
+package silvia
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spillSegmentExt = ".seg"
+	// Length and checksum of every record
+	spillHeaderSize = 8
+	// Max records drained to sink in a batch
+	spillDrainRows = 100
+	// Longer records are considered corrupted
+	spillMaxRecord = 64 << 20
+)
+
+var (
+	errSpillFull = errors.New("Spill is full")
+
+	spillTable = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type (
+	// Spill is a write-ahead queue of raw messages on disk, kept for a sink
+	// which is down and drained in order once it's back. Records are
+	// appended to segment files, <seq>.seg in Dir, each framed with its
+	// length and CRC-32C checksum. A segment is removed once all its
+	// records are written to the sink.
+	Spill struct {
+		sync.Mutex
+		Dir          string
+		MaxBytes     int64
+		SegmentBytes int64
+
+		// Oldest first, the last one is appended to if file is open
+		segments []*spillSegment
+		file     *os.File
+		// Committed read position in the oldest segment
+		read    SpillPosition
+		bytes   int64
+		records int
+		notify  chan struct{}
+	}
+
+	// SpillPosition is offset in the oldest segment and count of records
+	// before it
+	SpillPosition struct {
+		Offset  int64
+		Records int
+	}
+
+	spillSegment struct {
+		seq     uint64
+		path    string
+		size    int64
+		records int
+	}
+
+	SpillStatus struct {
+		Segments int
+		Records  int
+		Bytes    int64
+		MaxBytes int64
+	}
+)
+
+// OpenSpill opens spill in dir with records left by previous runs.
+// Records after a corrupted one are dropped from the segment.
+func OpenSpill(dir string, maxBytes int64, segmentBytes int64) (*Spill, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	spill := &Spill{Dir: dir, MaxBytes: maxBytes, SegmentBytes: segmentBytes, notify: make(chan struct{}, 1)}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, spillSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spillSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		segment := &spillSegment{seq: seq, path: filepath.Join(dir, name)}
+		err = segment.scan()
+		if err != nil {
+			return nil, err
+		}
+		if segment.records == 0 {
+			os.Remove(segment.path)
+			continue
+		}
+		spill.segments = append(spill.segments, segment)
+		spill.bytes += segment.size
+		spill.records += segment.records
+	}
+	sort.Slice(spill.segments, func(i, j int) bool {
+		return spill.segments[i].seq < spill.segments[j].seq
+	})
+	return spill, nil
+}
+
+// scan counts valid records of the segment, size is cut after the last one
+func (segment *spillSegment) scan() error {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		payload, err := readSpillRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			log.Printf("Spill segment %s is corrupted at %d: %s", segment.path, segment.size, err)
+			return nil
+		}
+		segment.size += int64(spillHeaderSize + len(payload))
+		segment.records++
+	}
+}
+
+// readSpillRecord returns payload of the next record, io.EOF at the end
+func readSpillRecord(reader io.Reader) ([]byte, error) {
+	header := make([]byte, spillHeaderSize)
+	_, err := io.ReadFull(reader, header)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated header")
+		}
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:4])
+	if length > spillMaxRecord {
+		return nil, fmt.Errorf("invalid record length %d", length)
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	if err != nil {
+		return nil, errors.New("truncated record")
+	}
+	if crc32.Checksum(payload, spillTable) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// Append writes record to the newest segment and syncs it to disk.
+// Returns errSpillFull if spill would exceed MaxBytes.
+func (spill *Spill) Append(record *ArchiveRecord) error {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, spillHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(payload, spillTable))
+	copy(frame[spillHeaderSize:], payload)
+
+	spill.Lock()
+	defer spill.Unlock()
+
+	if spill.bytes+int64(len(frame)) > spill.MaxBytes {
+		return errSpillFull
+	}
+
+	segment := spill.head(len(spill.segments) - 1)
+	if spill.file == nil || segment.size+int64(len(frame)) > spill.SegmentBytes {
+		segment, err = spill.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = spill.file.Write(frame)
+	if err == nil {
+		err = spill.file.Sync()
+	}
+	if err != nil {
+		// Partial record is cut on open
+		spill.closeFile()
+		return err
+	}
+
+	segment.size += int64(len(frame))
+	segment.records++
+	spill.bytes += int64(len(frame))
+	spill.records++
+
+	select {
+	case spill.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// head returns segment i or nil
+func (spill *Spill) head(i int) *spillSegment {
+	if i < 0 || i >= len(spill.segments) {
+		return nil
+	}
+	return spill.segments[i]
+}
+
+// rotate closes the segment appended to and starts the next one
+func (spill *Spill) rotate() (*spillSegment, error) {
+	spill.closeFile()
+
+	var seq uint64 = 1
+	if last := spill.head(len(spill.segments) - 1); last != nil {
+		seq = last.seq + 1
+	}
+	segment := &spillSegment{seq: seq, path: filepath.Join(spill.Dir, fmt.Sprintf("%020d%s", seq, spillSegmentExt))}
+
+	file, err := os.OpenFile(segment.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	spill.file = file
+	spill.segments = append(spill.segments, segment)
+	return segment, nil
+}
+
+func (spill *Spill) closeFile() {
+	if spill.file != nil {
+		spill.file.Close()
+		spill.file = nil
+	}
+}
+
+// Read returns up to max oldest records of the same tracker and position
+// to Commit once they are written
+func (spill *Spill) Read(max int) ([]*ArchiveRecord, SpillPosition, error) {
+	spill.Lock()
+	defer spill.Unlock()
+
+	position := spill.read
+	segment := spill.head(0)
+	if segment == nil {
+		return nil, position, nil
+	}
+
+	file, err := os.Open(segment.path)
+	if os.IsNotExist(err) {
+		log.Printf("Spill segment %s is removed, %d records lost", segment.path, segment.records-position.Records)
+		return nil, SpillPosition{Offset: segment.size, Records: segment.records}, nil
+	}
+	if err != nil {
+		return nil, position, err
+	}
+	defer file.Close()
+	_, err = file.Seek(position.Offset, io.SeekStart)
+	if err != nil {
+		return nil, position, err
+	}
+
+	var records []*ArchiveRecord
+	reader := bufio.NewReader(io.LimitReader(file, segment.size-position.Offset))
+	for len(records) < max && position.Offset < segment.size {
+		payload, err := readSpillRecord(reader)
+		if err != nil {
+			// Changed on disk since it was scanned, rest of segment is lost
+			log.Printf("Spill segment %s is corrupted at %d: %s", segment.path, position.Offset, err)
+			return records, SpillPosition{Offset: segment.size, Records: segment.records}, nil
+		}
+
+		record := &ArchiveRecord{}
+		err = json.Unmarshal(payload, record)
+		if err != nil {
+			log.Printf("Can't decode spilled record %.100s: %s", payload, err)
+		} else if len(records) > 0 && records[0].Tracker != record.Tracker {
+			break
+		} else {
+			records = append(records, record)
+		}
+		position.Offset += int64(spillHeaderSize + len(payload))
+		position.Records++
+	}
+	return records, position, nil
+}
+
+// Commit releases records read up to position, the oldest segment is
+// removed once it's read entirely
+func (spill *Spill) Commit(position SpillPosition) error {
+	spill.Lock()
+	defer spill.Unlock()
+
+	segment := spill.head(0)
+	if segment == nil {
+		return nil
+	}
+
+	spill.bytes -= position.Offset - spill.read.Offset
+	spill.records -= position.Records - spill.read.Records
+	spill.read = position
+	if position.Offset < segment.size {
+		return nil
+	}
+
+	if len(spill.segments) == 1 {
+		spill.closeFile()
+	}
+	spill.segments = spill.segments[1:]
+	spill.read = SpillPosition{}
+	err := os.Remove(segment.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Empty reports whether every record is written to the sink
+func (spill *Spill) Empty() bool {
+	spill.Lock()
+	defer spill.Unlock()
+	return spill.records == 0
+}
+
+func (spill *Spill) Status() SpillStatus {
+	spill.Lock()
+	defer spill.Unlock()
+	return SpillStatus{
+		Segments: len(spill.segments),
+		Records:  spill.records,
+		Bytes:    spill.bytes,
+		MaxBytes: spill.MaxBytes,
+	}
+}
+
+func (spill *Spill) Close() error {
+	spill.Lock()
+	defer spill.Unlock()
+	spill.closeFile()
+	return nil
+}
+
+// spilling reports whether events for the sink go to its spill: while
+// it's down and until the spill is drained, to keep them in order
+func (sink *SinkState) spilling() bool {
+	return sink.Spill != nil && (!sink.Health.Get() || !sink.Spill.Empty())
+}
+
+// drain writes spilled records to the sink in order whenever it's healthy
+// until ctx is done or the sink is disabled. Records failed to be written
+// are kept in the spill and retried with exponential backoff.
+func (sink *SinkState) drain(ctx context.Context) {
+	backoff := sinkMinBackoff
+	for {
+		for sink.Spill.Empty() {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sink.disabled:
+				return
+			case <-sink.Spill.notify:
+			case <-time.After(sinkPingInterval):
+			}
+		}
+		if !sink.waitHealthy(ctx) {
+			return
+		}
+
+		records, position, err := sink.Spill.Read(spillDrainRows)
+		if err != nil {
+			log.Printf("Can't read %s spill: %s", sink.Name, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(sinkPingInterval):
+			}
+			continue
+		}
+
+		err = sink.drainRecords(ctx, records)
+		if err == errSinkDown {
+			return
+		}
+		if err != nil {
+			log.Printf("Can't write spilled records to %s, retrying in %s: %s", sink.Name, backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-sink.disabled:
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > sinkMaxBackoff {
+				backoff = sinkMaxBackoff
+			}
+			continue
+		}
+		backoff = sinkMinBackoff
+
+		err = sink.Spill.Commit(position)
+		if err != nil {
+			log.Printf("Can't commit %s spill: %s", sink.Name, err)
+		}
+	}
+}
+
+// drainRecords transforms records of a tracker again and writes them as
+// a batch, without events dropped as duplicates when they were spilled.
+// Events carry their record as delivery for sinks of raw messages, it has
+// nothing to acknowledge.
+// Rows rejected by the sink are written as failure rows, error is returned
+// if the batch can't be written even so.
+func (sink *SinkState) drainRecords(ctx context.Context, records []*ArchiveRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	bus := sink.Buses[records[0].Tracker]
+	if bus == nil {
+		log.Printf("Dropped %d spilled %s records of unknown tracker %s", len(records), sink.Name, records[0].Tracker)
+		return nil
+	}
+
+	tracker := bus.Tracker.Name()
+	var batch []Event
+	for _, record := range records {
+		payload := record.Payload()
+		delivery := &Delivery{Body: payload, Tracker: record.Tracker, Received: record.Received}
+		events, err := transform(bus.Tracker, payload)
+		if err != nil {
+			events[0].SetError(transformErrorType(err), err, payload)
+		}
+		for i, event := range events {
+			event.SetDelivery(delivery)
+			if err != nil || !inInts(record.Dropped, i) {
+				batch = append(batch, event)
+			}
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	rejected, err := sink.writeSplit(ctx, bus.Tracker.Table(), batch)
+	metrics.WriteLatency.Since(start, sink.Name, tracker)
+	if err == errSinkDown {
+		return err
+	}
+	if err != nil {
+		metrics.WriteFailed.Add(float64(len(batch)), sink.Name, tracker)
+		return fmt.Errorf("%s batch: %s", tracker, err)
+	}
+	metrics.WriteFailed.Add(float64(len(rejected)), sink.Name, tracker)
+	metrics.Written.Add(float64(len(batch)-len(rejected)), sink.Name, tracker)
+	if len(rejected) > 0 {
+		log.Printf("Wrote %d rejected spilled %s rows to %s as failures", len(rejected), tracker, sink.Name)
+	}
+
+	for _, event := range batch {
+		if rejected[event] != nil {
+			bus.FailRing.Add(event, rejected[event])
+		} else {
+			bus.SuccessRing.Add(event, nil)
+		}
+	}
+	return nil
+}
+
+func inInts(values []int, value int) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
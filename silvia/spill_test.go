@@ -0,0 +1,330 @@
+package silvia
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSpill(t *testing.T, maxBytes int64, segmentBytes int64) (*Spill, func()) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spill, err := OpenSpill(dir, maxBytes, segmentBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spill, func() { os.RemoveAll(dir) }
+}
+
+func spillRecord(tracker string, body string) *ArchiveRecord {
+	return &ArchiveRecord{Tracker: tracker, Body: body, Received: time.Date(2016, 4, 15, 17, 46, 55, 0, time.UTC)}
+}
+
+func TestSpill(t *testing.T) {
+	spill, cleanup := newTestSpill(t, 1<<20, 150)
+	defer cleanup()
+
+	for _, record := range []*ArchiveRecord{
+		spillRecord("adjust", "1"), spillRecord("adjust", "2"), spillRecord("snowplow", "3"), spillRecord("adjust", "4"),
+	} {
+		err := spill.Append(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	status := spill.Status()
+	if status.Records != 4 || status.Segments < 2 {
+		t.Errorf("Records must be appended to rotated segments: %+v", status)
+	}
+
+	var bodies []string
+	for !spill.Empty() {
+		records, position, err := spill.Read(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 0 {
+			t.Fatalf("Records left, but nothing read: %+v", spill.Status())
+		}
+		batch := ""
+		for _, record := range records {
+			if record.Tracker != records[0].Tracker {
+				t.Errorf("Batch must have records of a single tracker")
+			}
+			batch += record.Body
+		}
+		bodies = append(bodies, batch)
+
+		err = spill.Commit(position)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(bodies) != 3 || bodies[0] != "12" || bodies[1] != "3" || bodies[2] != "4" {
+		t.Errorf("Records must be read in order, got %v", bodies)
+	}
+	if status := spill.Status(); status.Bytes != 0 || status.Segments != 0 {
+		t.Errorf("Drained spill must be empty: %+v", status)
+	}
+	if files, _ := ioutil.ReadDir(spill.Dir); len(files) != 0 {
+		t.Errorf("Drained segments must be removed, got %d files", len(files))
+	}
+
+	// Segment is started again once the last one is drained
+	spill.Append(spillRecord("adjust", "5"))
+	records, _, _ := spill.Read(10)
+	if len(records) != 1 || records[0].Body != "5" {
+		t.Errorf("Unexpected records: %v", records)
+	}
+}
+
+func TestSpillFull(t *testing.T) {
+	spill, cleanup := newTestSpill(t, 100, 1<<20)
+	defer cleanup()
+
+	err := spill.Append(spillRecord("adjust", "1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = spill.Append(spillRecord("adjust", "2"))
+	if err != errSpillFull {
+		t.Errorf("Expected full spill, got %v", err)
+	}
+	if status := spill.Status(); status.Records != 1 {
+		t.Errorf("Record must not be appended to full spill: %+v", status)
+	}
+}
+
+func TestSpillReopen(t *testing.T) {
+	spill, cleanup := newTestSpill(t, 1<<20, 1<<20)
+	defer cleanup()
+
+	for _, body := range []string{"1", "2", "3"} {
+		spill.Append(spillRecord("adjust", body))
+	}
+	records, position, _ := spill.Read(1)
+	spill.Commit(position)
+	spill.Close()
+
+	// Record torn by crash and garbage after it
+	path := filepath.Join(spill.Dir, "00000000000000000001.seg")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Records of equal bodies are of equal size
+	third := len(data) / 3 * 2
+	data[third+spillHeaderSize+2] ^= 0xff
+	ioutil.WriteFile(path, append(data, 0, 0, 1), 0644)
+
+	reopened, err := OpenSpill(spill.Dir, 1<<20, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	// Committed record is read again, records are at least once
+	records, _, _ = reopened.Read(10)
+	if len(records) != 2 || records[0].Body != "1" || records[1].Body != "2" {
+		t.Errorf("Records before corrupted one must be kept, got %v", records)
+	}
+	if status := reopened.Status(); status.Records != 2 {
+		t.Errorf("Unexpected status: %+v", status)
+	}
+}
+
+func TestSinkStateSpill(t *testing.T) {
+	defer fastReconnect()()
+
+	spill, cleanup := newTestSpill(t, 1<<20, 1<<20)
+	defer cleanup()
+
+	table := Table{Schema: "adjust", Name: "events"}
+	sink := &testSink{connectErrs: 1 << 30, batches: map[Table][][]Event{}}
+	state := newTestSinkState(sink, 1)
+	state.Spill = spill
+	worker := &Worker{Config: &Config{}, Sinks: []*SinkState{state}}
+
+	ack := &testAcknowledger{}
+	for i, request := range []string{transformResults[0].request, transformResults[1].request} {
+		delivery := &Delivery{Tag: uint64(i), Tracker: "adjust", Body: []byte(request), acknowledger: ack}
+		delivery.Add(1)
+		events := []Event{&AdjustEvent{Delivery: delivery}}
+		delivery.Done(worker.forward("adjust", delivery, events, events))
+	}
+	if len(ack.acks) != 2 || spill.Status().Records != 2 || len(state.Buses["adjust"].Events) != 0 {
+		t.Fatalf("Events for sink which is down must be spilled and acknowledged")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		state.Run(context.Background(), &Config{})
+		close(done)
+	}()
+	sink.Lock()
+	sink.connectErrs = 0
+	sink.Unlock()
+
+	for !spill.Empty() {
+		time.Sleep(time.Millisecond)
+	}
+	close(state.Buses["adjust"].Events)
+	close(state.Buses["snowplow"].Events)
+	<-done
+
+	batches := sink.batches[table]
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("Spill must be drained in a batch, got %v", batches)
+	}
+	if batches[0][0].(*AdjustEvent).Adid != transformResults[0].expected["Adid"] {
+		t.Errorf("Spilled events must be written in order")
+	}
+}
+
+func TestSpillDedup(t *testing.T) {
+	defer fastReconnect()()
+
+	spill, cleanup := newTestSpill(t, 1<<20, 1<<20)
+	defer cleanup()
+
+	table := Table{Schema: "atomic", Name: "events"}
+	sink := &testSink{connectErrs: 1 << 30, batches: map[Table][][]Event{}}
+	state := newTestSinkState(sink, 1)
+	state.Spill = spill
+	tracker := &TrackerState{
+		Tracker:     &SnowplowTracker{},
+		RequestBus:  make(chan *Delivery, 2),
+		SuccessRing: NewRing[Event](10),
+		FailRing:    NewRing[Event](10),
+		Dedup:       NewDedup(time.Minute),
+	}
+	worker := &Worker{Config: &Config{}, Trackers: []*TrackerState{tracker}, Sinks: []*SinkState{state}}
+
+	// The first event of the batch is a duplicate of GET pixel request
+	ack := &testAcknowledger{}
+	for i, request := range []string{transformSnowplowResults[1].request, transformSnowplowResults[0].request} {
+		tracker.RequestBus <- &Delivery{Tag: uint64(i), Body: []byte(request), acknowledger: ack}
+	}
+	close(tracker.RequestBus)
+	worker.Transformer()
+	worker.pipeline.Wait()
+	if len(ack.acks) != 2 || spill.Status().Records != 2 {
+		t.Fatalf("Messages must be spilled and acknowledged")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		state.Run(context.Background(), &Config{})
+		close(done)
+	}()
+	sink.Lock()
+	sink.connectErrs = 0
+	sink.Unlock()
+
+	for !spill.Empty() {
+		time.Sleep(time.Millisecond)
+	}
+	close(state.Buses["adjust"].Events)
+	<-done
+
+	var eventIDs []string
+	for _, batch := range sink.batches[table] {
+		for _, event := range batch {
+			eventIDs = append(eventIDs, event.(*SnowplowEvent).EventID.String)
+		}
+	}
+	if len(eventIDs) != 2 || eventIDs[0] != transformSnowplowResults[1].events[0] || eventIDs[1] != transformSnowplowResults[0].events[1] {
+		t.Errorf("Duplicates must not be written from spill, got %v", eventIDs)
+	}
+}
+
+func TestSpillDrainRetry(t *testing.T) {
+	defer fastReconnect()()
+
+	spill, cleanup := newTestSpill(t, 1<<20, 1<<20)
+	defer cleanup()
+
+	for _, request := range []string{transformResults[0].request, transformResults[1].request} {
+		if err := spill.Append(spillRecord("adjust", request)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Healthy sink fails the batch and its failure rows
+	table := Table{Schema: "adjust", Name: "events"}
+	sink := &testSink{err: errors.New("disk full"), batches: map[Table][][]Event{}}
+	state := newTestSinkState(sink, 1)
+	state.Spill = spill
+
+	done := make(chan struct{})
+	go func() {
+		state.Run(context.Background(), &Config{})
+		close(done)
+	}()
+
+	for sink.written(table) < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	if spill.Status().Records != 2 {
+		t.Errorf("Failed batch must be kept in spill, got %d records", spill.Status().Records)
+	}
+	sink.fail(nil)
+
+	for !spill.Empty() {
+		time.Sleep(time.Millisecond)
+	}
+	close(state.Buses["adjust"].Events)
+	close(state.Buses["snowplow"].Events)
+	<-done
+
+	sink.Lock()
+	defer sink.Unlock()
+	if len(sink.rows) != 2 || sink.rows[0].(*AdjustEvent).Adid != transformResults[0].expected["Adid"] {
+		t.Errorf("Failed batch must be retried until it's written, got %v", sink.rows)
+	}
+}
+
+func TestSpillArchive(t *testing.T) {
+	defer fastReconnect()()
+
+	spill, cleanup := newTestSpill(t, 1<<20, 1<<20)
+	defer cleanup()
+	now := time.Date(2016, 4, 15, 17, 59, 0, 0, time.UTC)
+	archive, cleanupArchive := newTestArchive(t, &now)
+	defer cleanupArchive()
+
+	requests := []string{transformResults[0].request, transformResults[1].request}
+	for _, request := range requests {
+		if err := spill.Append(spillRecord("adjust", request)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state := newTestSinkState(archive, 1)
+	state.Spill = spill
+	done := make(chan struct{})
+	go func() {
+		state.Run(context.Background(), &Config{ArchiveDir: archive.Dir})
+		close(done)
+	}()
+
+	for !spill.Empty() {
+		time.Sleep(time.Millisecond)
+	}
+	close(state.Buses["adjust"].Events)
+	close(state.Buses["snowplow"].Events)
+	<-done
+
+	records := readArchive(t, filepath.Join(archive.Dir, "adjust", "2016-04-15", "17.ndjson.gz"))
+	if len(records) != 2 || records[0].Body != requests[0] || records[1].Body != requests[1] ||
+		!records[0].Received.Equal(spillRecord("adjust", "").Received) {
+		t.Errorf("Spilled messages must be archived on drain, got %v", records)
+	}
+}
@@ -0,0 +1,187 @@
+package silvia
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// Staging files are tab-delimited text, COPY loads them with ESCAPE so
+// backslash, tab and newline in values are escaped with backslash and a
+// literal \N doesn't collide with the null marker.
+const (
+	stageNull       = `\N`
+	stageTimeFormat = "2006-01-02 15:04:05.999999"
+)
+
+var stageEscaper = strings.NewReplacer(`\`, `\\`, "\t", "\\\t", "\n", "\\\n", "\r", "\\\r")
+
+type (
+	// RedshiftStage loads batches of events into Redshift through gzipped
+	// text files staged in S3-compatible storage and COPY with a manifest.
+	RedshiftStage struct {
+		S3      *S3
+		Prefix  string
+		IamRole string
+	}
+
+	Manifest struct {
+		Entries []ManifestEntry `json:"entries"`
+	}
+
+	ManifestEntry struct {
+		URL       string `json:"url"`
+		Mandatory bool   `json:"mandatory"`
+	}
+
+	execer interface {
+		Exec(query string, args ...interface{}) (sql.Result, error)
+	}
+)
+
+func NewRedshiftStage(config *Config) (*RedshiftStage, error) {
+	s3, err := NewS3(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RedshiftStage{
+		S3:      s3,
+		Prefix:  strings.Trim(config.S3Prefix, "/"),
+		IamRole: config.RedshiftIamRole,
+	}, nil
+}
+
+// Copy uploads events as a single staging file with its manifest and
+// loads it into schema.table. Staged objects are removed once COPY is
+// done, whatever its outcome: COPY reads them while it runs and a retry
+// stages the batch again.
+func (stage *RedshiftStage) Copy(db execer, schema string, table string, columns []string, events []interface{}) error {
+	data, err := getStageEvents(events)
+	if err != nil {
+		return err
+	}
+
+	key := stage.key(schema, table, time.Now().UTC())
+	err = stage.S3.PutObject(key+".tsv.gz", data, "application/gzip")
+	if err != nil {
+		return err
+	}
+	defer stage.remove(key + ".tsv.gz")
+
+	manifest, err := json.Marshal(Manifest{
+		Entries: []ManifestEntry{{URL: stage.S3.URL(key + ".tsv.gz"), Mandatory: true}},
+	})
+	if err != nil {
+		return err
+	}
+
+	err = stage.S3.PutObject(key+".manifest", manifest, "application/json")
+	if err != nil {
+		return err
+	}
+	defer stage.remove(key + ".manifest")
+
+	// Query has credentials unless IAM role is set, keep it out of errors
+	_, err = db.Exec(stage.copyQuery(schema, table, columns, stage.S3.URL(key+".manifest")))
+	if err != nil {
+		return fmt.Errorf("Can't copy %s to %s.%s: %w", key, schema, table, err)
+	}
+	return nil
+}
+
+// remove deletes staged object, leftovers don't fail the batch which is
+// already loaded
+func (stage *RedshiftStage) remove(key string) {
+	if err := stage.S3.DeleteObject(key); err != nil {
+		log.Println("Can't remove staging file:", err)
+	}
+}
+
+// key returns staging object name without extension, unique per batch
+func (stage *RedshiftStage) key(schema string, table string, now time.Time) string {
+	return path.Join(stage.Prefix, schema+"."+table, now.Format("2006/01/02"), now.Format("150405")+"-"+uuid.NewV4().String())
+}
+
+func (stage *RedshiftStage) copyQuery(schema string, table string, columns []string, manifestURL string) string {
+	var credentials string
+	if stage.IamRole != "" {
+		credentials = fmt.Sprintf("IAM_ROLE %s", quoteLiteral(stage.IamRole))
+	} else {
+		credentials = fmt.Sprintf("ACCESS_KEY_ID %s SECRET_ACCESS_KEY %s", quoteLiteral(stage.S3.AccessKey), quoteLiteral(stage.S3.SecretKey))
+	}
+
+	return fmt.Sprintf(
+		"COPY \"%s\".\"%s\" (\"%s\") FROM %s %s MANIFEST GZIP DELIMITER '\\t' ESCAPE NULL AS '\\N' TIMEFORMAT 'auto' REGION %s;",
+		schema, table, strings.Join(columns, "\", \""), quoteLiteral(manifestURL), credentials, quoteLiteral(stage.S3.Region),
+	)
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// getStageEvents encodes events as gzipped tab-delimited rows, columns in
+// the same order as GetColumns returns them.
+func getStageEvents(events []interface{}) ([]byte, error) {
+	var data bytes.Buffer
+	gz := gzip.NewWriter(&data)
+
+	for _, event := range events {
+		row, err := getStageEventValues(event)
+		if err != nil {
+			return nil, err
+		}
+		_, err = gz.Write([]byte(strings.Join(row, "\t") + "\n"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// getStageEventValues returns escaped values of event, stageNull for NULLs
+func getStageEventValues(event interface{}) ([]string, error) {
+	var row []string
+
+	for _, value := range getEventValues(event) {
+		switch value := value.(type) {
+		case time.Time:
+			row = append(row, value.UTC().Format(stageTimeFormat))
+			continue
+		case NullTime:
+			if value.Valid {
+				row = append(row, value.Time.UTC().Format(stageTimeFormat))
+			} else {
+				row = append(row, stageNull)
+			}
+			continue
+		}
+
+		val, err := driver.DefaultParameterConverter.ConvertValue(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if val == nil {
+			row = append(row, stageNull)
+			continue
+		}
+		row = append(row, stageEscaper.Replace(fmt.Sprintf("%v", val)))
+	}
+
+	return row, nil
+}
@@ -0,0 +1,244 @@
+package silvia
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/gorp.v1"
+)
+
+// testObjectStorage is a MinIO-style stand-in accepting path-style PUTs
+// and DELETEs, objects keep uploads after they're deleted
+type testObjectStorage struct {
+	sync.Mutex
+	objects map[string][]byte
+	deleted []string
+	t       *testing.T
+}
+
+func (storage *testObjectStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=minio/") {
+		storage.t.Errorf("Unsigned request: %s", r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") != sha256Hex(body) {
+		storage.t.Errorf("Payload hash mismatch for %s", r.URL.Path)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	storage.Lock()
+	defer storage.Unlock()
+	if r.Method == http.MethodDelete {
+		storage.deleted = append(storage.deleted, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	storage.objects[r.URL.Path] = body
+}
+
+// testExecer records statements and fails them with err, tables it's
+// asked for have columns
+type testExecer struct {
+	queries []string
+	args    []int
+	columns []string
+	err     error
+}
+
+func (db *testExecer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	db.queries = append(db.queries, query)
+	db.args = append(db.args, len(args))
+	return nil, db.err
+}
+
+func (db *testExecer) Select(i interface{}, query string, args ...interface{}) ([]interface{}, error) {
+	db.queries = append(db.queries, query)
+	*i.(*[]string) = db.columns
+	return nil, nil
+}
+
+func newTestStage(t *testing.T) (*RedshiftStage, *testObjectStorage, func()) {
+	storage := &testObjectStorage{objects: map[string][]byte{}, t: t}
+	server := httptest.NewServer(storage)
+
+	endpoint, _ := url.Parse(server.URL)
+	stage := &RedshiftStage{
+		S3: &S3{
+			Endpoint:   endpoint,
+			Region:     "eu-central-1",
+			Bucket:     "silvia",
+			AccessKey:  "minio",
+			SecretKey:  "minio123",
+			HttpClient: server.Client(),
+		},
+		Prefix: "staging",
+	}
+	return stage, storage, server.Close
+}
+
+func TestRedshiftStageCopy(t *testing.T) {
+	stage, storage, closeStorage := newTestStage(t)
+	defer closeStorage()
+
+	event := &AdjustEvent{}
+	event.Transform([]byte(transformResults[0].request))
+	events := []interface{}{event, &AdjustEvent{}}
+
+	db := &testExecer{}
+	columns := []string{"app_id", "app_name"}
+	err := stage.Copy(db, "adjust", "events", columns, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(storage.objects) != 2 {
+		t.Fatalf("Expected data file and manifest, got %d objects", len(storage.objects))
+	}
+
+	var manifestPath, dataPath string
+	for objectPath := range storage.objects {
+		if strings.HasSuffix(objectPath, ".manifest") {
+			manifestPath = objectPath
+		} else {
+			dataPath = objectPath
+		}
+	}
+	if !strings.HasPrefix(dataPath, "/silvia/staging/adjust.events/") || !strings.HasSuffix(dataPath, ".tsv.gz") {
+		t.Errorf("Unexpected data file path: %s", dataPath)
+	}
+
+	manifest := &Manifest{}
+	err = json.Unmarshal(storage.objects[manifestPath], manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Entries) != 1 || manifest.Entries[0].URL != "s3:/"+dataPath || !manifest.Entries[0].Mandatory {
+		t.Errorf("Manifest doesn't point to data file: %+v", manifest)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(storage.objects[dataPath]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 rows, got %d", len(lines))
+	}
+	row := strings.Split(lines[0], "\t")
+	if row[0] != "1011771034" || row[1] != "com.qlean.qlean" {
+		t.Errorf("Unexpected first row: %v", row[:2])
+	}
+	for _, value := range strings.Split(lines[1], "\t") {
+		if value != stageNull {
+			t.Errorf("Empty event must be loaded as NULLs, got %q", value)
+			break
+		}
+	}
+
+	if len(db.queries) != 1 {
+		t.Fatalf("Expected single COPY, got %d queries", len(db.queries))
+	}
+	query := db.queries[0]
+	for _, expected := range []string{
+		`COPY "adjust"."events" ("app_id", "app_name") FROM 's3:/` + manifestPath + `'`,
+		`ACCESS_KEY_ID 'minio' SECRET_ACCESS_KEY 'minio123'`,
+		`MANIFEST GZIP DELIMITER '\t' ESCAPE NULL AS '\N'`,
+		`REGION 'eu-central-1'`,
+	} {
+		if !strings.Contains(query, expected) {
+			t.Errorf("COPY query %q doesn't contain %q", query, expected)
+		}
+	}
+
+	if len(storage.deleted) != 2 {
+		t.Errorf("Staged objects must be removed after COPY, removed %v", storage.deleted)
+	}
+}
+
+func TestRedshiftStageCopyError(t *testing.T) {
+	stage, storage, closeStorage := newTestStage(t)
+	defer closeStorage()
+
+	db := &testExecer{err: errors.New("pq: S3ServiceException: Access Denied")}
+	err := stage.Copy(db, "adjust", "events", []string{"app_id"}, []interface{}{&AdjustEvent{}})
+	if err == nil || !strings.Contains(err.Error(), "Access Denied") {
+		t.Fatalf("Expected COPY error, got %v", err)
+	}
+	if strings.Contains(err.Error(), stage.S3.SecretKey) {
+		t.Errorf("Error must not contain credentials: %s", err)
+	}
+	if len(storage.deleted) != 2 {
+		t.Errorf("Staged objects must be removed after failed COPY, removed %v", storage.deleted)
+	}
+}
+
+func TestRedshiftStageIamRole(t *testing.T) {
+	stage, _, closeStorage := newTestStage(t)
+	defer closeStorage()
+	stage.IamRole = "arn:aws:iam::0123456789:role/redshift-loader"
+
+	query := stage.copyQuery("atomic", "events", []string{"event_id"}, "s3://silvia/batch.manifest")
+	if !strings.Contains(query, "IAM_ROLE 'arn:aws:iam::0123456789:role/redshift-loader'") || strings.Contains(query, "ACCESS_KEY_ID") {
+		t.Errorf("COPY query must use IAM role: %s", query)
+	}
+}
+
+func TestStageEventValues(t *testing.T) {
+	event := &SnowplowEvent{}
+	event.CollectorTstamp = time.Date(2016, 4, 15, 17, 46, 55, 123000000, time.UTC)
+	checkStringForNull("Page \"title\", with quote'\tand \\N\n", &event.PageTtile)
+
+	row, err := getStageEventValues(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	columns := GetColumns(snowplowTableMap())
+	if len(row) != len(columns) {
+		t.Fatalf("Expected %d values, got %d", len(columns), len(row))
+	}
+	for i, column := range columns {
+		switch column {
+		case "collector_tstamp":
+			if row[i] != "2016-04-15 17:46:55.123" {
+				t.Errorf("Unexpected timestamp: %s", row[i])
+			}
+		case "page_title":
+			if row[i] != "Page \"title\", with quote'\\\tand \\\\N\\\n" {
+				t.Errorf("Unexpected page title: %s", row[i])
+			}
+		case "app_id":
+			if row[i] != stageNull {
+				t.Errorf("Unexpected app_id: %s", row[i])
+			}
+		}
+	}
+}
+
+func snowplowTableMap() *gorp.TableMap {
+	dbmap := &gorp.DbMap{Dialect: gorp.PostgresDialect{}}
+	return dbmap.AddTableWithNameAndSchema(SnowplowEvent{}, "atomic", "events")
+}
@@ -0,0 +1,210 @@
+package silvia
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sort"
+
+	"github.com/abh/geoip"
+)
+
+type (
+	// Event is a transformed tracker event written to sinks
+	Event interface {
+		// GetDelivery returns RabbitMQ message event was transformed from
+		GetDelivery() *Delivery
+		SetDelivery(delivery *Delivery)
+		// DedupKey identifies event among retries of trackers, empty
+		// if the event can't be told from others
+		DedupKey() string
+		// SetError turns event into a failure row for raw payload
+		SetError(errType string, err error, raw []byte)
+		// Failure returns failure row of the request event was transformed
+		// from, without values of the event
+		Failure(errType string, err error) Event
+	}
+
+	// Table is a destination table of tracker events
+	Table struct {
+		Schema string
+		Name   string
+	}
+
+	// Tracker is a source of events consumed from its RabbitMQ queue.
+	// Transform returns every event of request, on error the only event
+	// returned is written as failure. NewEvent returns empty event of the
+	// tracker, failure of request is written as it if Transform panics.
+	Tracker interface {
+		Name() string
+		Queue() string
+		Table() Table
+		Transform(request []byte) ([]Event, error)
+		NewEvent() Event
+	}
+
+	// TrackerState is a registered tracker with its request bus, rings
+	// and dedup of its events, nil if dedup_window is zero
+	TrackerState struct {
+		Tracker    Tracker
+		RequestBus chan *Delivery
+		Dedup      *Dedup
+
+		SuccessRing *Ring[Event]
+		FailRing    *Ring[Event]
+	}
+
+	TrackerStatus struct {
+		Success int
+		Failed  int
+		Dedup   *DedupStatus `json:",omitempty"`
+	}
+
+	// PanicError is a panic recovered while transforming an event
+	PanicError struct {
+		Value interface{}
+		Stack []byte
+	}
+
+	AdjustTracker struct{}
+
+	SnowplowTracker struct {
+		GeoDB   *geoip.GeoIP
+		Schemas *SchemaRegistry
+	}
+)
+
+var trackerDrivers = map[string]func(config *Config) (Tracker, error){}
+
+func init() {
+	RegisterTracker("adjust", func(config *Config) (Tracker, error) {
+		return &AdjustTracker{}, nil
+	})
+	RegisterTracker("snowplow", func(config *Config) (Tracker, error) {
+		geoDB, err := geoip.Open("GeoLiteCity.dat")
+		if err != nil {
+			return nil, err
+		}
+		tracker := &SnowplowTracker{GeoDB: geoDB}
+		if config.IgluDir != "" {
+			tracker.Schemas, err = LoadSchemas(config.IgluDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return tracker, nil
+	})
+}
+
+// RegisterTracker makes tracker created by new available under name
+func RegisterTracker(name string, new func(config *Config) (Tracker, error)) {
+	if _, exist := trackerDrivers[name]; exist {
+		panic("Tracker already registered: " + name)
+	}
+	trackerDrivers[name] = new
+}
+
+// newTrackers creates states for every registered tracker, ordered by name
+func newTrackers(config *Config, ringSize int) ([]*TrackerState, error) {
+	var names []string
+	for name := range trackerDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var trackers []*TrackerState
+	for _, name := range names {
+		tracker, err := trackerDrivers[name](config)
+		if err != nil {
+			return nil, fmt.Errorf("%s tracker: %s", name, err)
+		}
+
+		state := &TrackerState{
+			Tracker:     tracker,
+			RequestBus:  make(chan *Delivery),
+			SuccessRing: NewRing[Event](ringSize),
+			FailRing:    NewRing[Event](ringSize),
+		}
+		if config.DedupWindow > 0 {
+			state.Dedup = NewDedup(config.DedupWindow)
+		}
+		trackers = append(trackers, state)
+	}
+	return trackers, nil
+}
+
+// transformErrorType is error type of event failed to transform, events
+// failed validation against their schemas are told from malformed ones
+func transformErrorType(err error) string {
+	var schemaErr *SchemaError
+	if errors.As(err, &schemaErr) {
+		return "Schema"
+	}
+	return "Transform"
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n\n%s", err.Value, err.Stack)
+}
+
+// recoverTransform turns panic on malformed request into PanicError, so
+// the event is written as failure instead of crashing the worker. Parsers
+// of built-in trackers defer it where they decode payloads, so a Snowplow
+// failure names its event. transform recovers panics of any tracker on top
+// of that. It must be deferred directly, recover doesn't work otherwise.
+func recoverTransform(err *error) {
+	if value := recover(); value != nil {
+		*err = &PanicError{Value: value, Stack: debug.Stack()}
+	}
+}
+
+// transform returns events of request. Panic of tracker is recovered as
+// failure of the whole request, whether the tracker recovers it or not.
+func transform(tracker Tracker, request []byte) (events []Event, err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			events = []Event{tracker.NewEvent()}
+			err = &PanicError{Value: value, Stack: debug.Stack()}
+		}
+	}()
+	return tracker.Transform(request)
+}
+
+func (tracker *TrackerState) Status() TrackerStatus {
+	status := TrackerStatus{
+		Success: tracker.SuccessRing.Total(),
+		Failed:  tracker.FailRing.Total(),
+	}
+	if tracker.Dedup != nil {
+		dedup := tracker.Dedup.Status()
+		status.Dedup = &dedup
+	}
+	return status
+}
+
+func (tracker *AdjustTracker) Name() string  { return "adjust" }
+func (tracker *AdjustTracker) Queue() string { return "adjust" }
+func (tracker *AdjustTracker) Table() Table  { return Table{Schema: "adjust", Name: "events"} }
+
+func (tracker *AdjustTracker) NewEvent() Event { return &AdjustEvent{} }
+
+func (tracker *AdjustTracker) Transform(request []byte) ([]Event, error) {
+	event := &AdjustEvent{}
+	err := event.Transform(request)
+	return []Event{event}, err
+}
+
+func (tracker *SnowplowTracker) Name() string  { return "snowplow" }
+func (tracker *SnowplowTracker) Queue() string { return "snowplow" }
+func (tracker *SnowplowTracker) Table() Table  { return Table{Schema: "atomic", Name: "events"} }
+
+func (tracker *SnowplowTracker) NewEvent() Event { return &SnowplowEvent{} }
+
+func (tracker *SnowplowTracker) Transform(request []byte) ([]Event, error) {
+	snowplowEvents, err := TransformSnowplow(request, tracker.GeoDB, tracker.Schemas)
+	events := make([]Event, len(snowplowEvents))
+	for i, event := range snowplowEvents {
+		events[i] = event
+	}
+	return events, err
+}
@@ -0,0 +1,375 @@
+package silvia
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+var transformerResults = []struct {
+	title   string
+	tracker Tracker
+	request string
+	errType string
+	panics  float64
+}{
+	{`Transformed event`, &AdjustTracker{}, transformResults[0].request, "", 0},
+	{`Failed event is written as error`, &AdjustTracker{}, `%zz`, "Transform", 0},
+	{`Panic is written as error`, &panicTracker{}, transformResults[0].request, "Transform", 1},
+}
+
+func TestTransformer(t *testing.T) {
+	for _, testCase := range transformerResults {
+		sink := newTestSinkState(&testSink{}, 1)
+		sink.Health.Set(true)
+
+		tracker := &TrackerState{
+			Tracker:     testCase.tracker,
+			RequestBus:  make(chan *Delivery, 1),
+			SuccessRing: NewRing[Event](10),
+			FailRing:    NewRing[Event](10),
+		}
+		worker := &Worker{Config: &Config{}, Trackers: []*TrackerState{tracker}, Sinks: []*SinkState{sink}}
+
+		ack := &testAcknowledger{}
+		panics := metrics.TransformPanics.Get("adjust")
+		tracker.RequestBus <- &Delivery{Body: []byte(testCase.request), acknowledger: ack}
+		close(tracker.RequestBus)
+		worker.Transformer()
+		worker.pipeline.Wait()
+
+		event, ok := <-sink.Buses["adjust"].Events
+		if !ok {
+			t.Fatalf("Failed on: %s\nEvent wasn't forwarded", testCase.title)
+		}
+		if _, ok := <-sink.Buses["adjust"].Events; ok {
+			t.Errorf("Failed on: %s\nSink bus must be closed", testCase.title)
+		}
+
+		adjustEvent := event.(*AdjustEvent)
+		if adjustEvent.ErrType.String != testCase.errType {
+			t.Errorf("Failed on: %s\nErrType: %q", testCase.title, adjustEvent.ErrType.String)
+		}
+		if metrics.TransformPanics.Get("adjust")-panics != testCase.panics {
+			t.Errorf("Failed on: %s\nPanics: %v", testCase.title, metrics.TransformPanics.Get("adjust")-panics)
+		}
+		if len(ack.acks)+len(ack.nacks) != 0 {
+			t.Errorf("Failed on: %s\nAcknowledged before written", testCase.title)
+		}
+
+		adjustEvent.GetDelivery().Done(nil)
+		if len(ack.acks) != 1 {
+			t.Errorf("Failed on: %s\nNot acknowledged after written", testCase.title)
+		}
+	}
+}
+
+func TestTransformerNoWriters(t *testing.T) {
+	sink := newTestSinkState(&testSink{}, 1)
+
+	tracker := &TrackerState{
+		Tracker:     &AdjustTracker{},
+		RequestBus:  make(chan *Delivery, 1),
+		SuccessRing: NewRing[Event](10),
+		FailRing:    NewRing[Event](10),
+	}
+	worker := &Worker{Config: &Config{}, Trackers: []*TrackerState{tracker}, Sinks: []*SinkState{sink}}
+
+	ack := &testAcknowledger{}
+	tracker.RequestBus <- &Delivery{Body: []byte(transformResults[0].request), acknowledger: ack}
+	close(tracker.RequestBus)
+	worker.Transformer()
+	worker.pipeline.Wait()
+
+	if len(ack.nacks) != 1 || !ack.requeue {
+		t.Errorf("Event must be requeued when no sink is healthy")
+	}
+}
+
+func TestTransformerDeadLetter(t *testing.T) {
+	sink := newTestSinkState(&testSink{}, 1)
+	sink.Health.Set(true)
+
+	tracker := &TrackerState{
+		Tracker:     &AdjustTracker{},
+		RequestBus:  make(chan *Delivery, 1),
+		SuccessRing: NewRing[Event](10),
+		FailRing:    NewRing[Event](10),
+	}
+	worker := &Worker{Config: &Config{DeadLetterExchange: "silvia.dead"}, Trackers: []*TrackerState{tracker}, Sinks: []*SinkState{sink}}
+
+	ack := &testAcknowledger{}
+	deadLetters := &testDeadLetters{}
+	tracker.RequestBus <- &Delivery{Body: []byte(`%zz`), acknowledger: ack, deadLetters: deadLetters}
+	close(tracker.RequestBus)
+	worker.Transformer()
+	worker.pipeline.Wait()
+
+	if _, ok := <-sink.Buses["adjust"].Events; ok {
+		t.Errorf("Dead-lettered event must not be written")
+	}
+	if len(deadLetters.published) != 1 || deadLetters.published[0].Stage != StageTransform || len(ack.acks) != 1 {
+		t.Errorf("Failed event must be dead-lettered and acked")
+	}
+	if tracker.FailRing.Total() != 1 {
+		t.Errorf("Failed event must be added to fail ring")
+	}
+}
+
+func TestForwardUnhealthySink(t *testing.T) {
+	healthy := newTestSinkState(&testSink{}, 1)
+	healthy.Health.Set(true)
+	down := newTestSinkState(&testSink{}, 1)
+	disabled := newTestSinkState(&testSink{}, 1)
+	disabled.Disable()
+	// Full bus stalls forwarding unless the sink is disabled
+	for len(disabled.Buses["adjust"].Events) < cap(disabled.Buses["adjust"].Events) {
+		disabled.Buses["adjust"].Events <- &AdjustEvent{}
+	}
+
+	worker := &Worker{Config: &Config{}, Sinks: []*SinkState{healthy, down, disabled}}
+	ack := &testAcknowledger{}
+	delivery := &Delivery{acknowledger: ack}
+	delivery.Add(1)
+	events := []Event{&AdjustEvent{Delivery: delivery}}
+	err := worker.forward("adjust", delivery, events, events)
+	delivery.Done(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(healthy.Buses["adjust"].Events) != 1 || len(down.Buses["adjust"].Events) != 1 {
+		t.Errorf("Event must be buffered for sink which is down")
+	}
+	(<-healthy.Buses["adjust"].Events).GetDelivery().Done(nil)
+	if len(ack.acks) != 0 {
+		t.Errorf("Message must not be acknowledged before buffered event is written")
+	}
+	(<-down.Buses["adjust"].Events).GetDelivery().Done(nil)
+	if len(ack.acks) != 1 {
+		t.Errorf("Message must be acknowledged once written to every enabled sink")
+	}
+}
+
+func TestTransformerDedup(t *testing.T) {
+	sink := newTestSinkState(&testSink{}, 2)
+	sink.Health.Set(true)
+
+	tracker := &TrackerState{
+		Tracker:     &AdjustTracker{},
+		RequestBus:  make(chan *Delivery, 2),
+		SuccessRing: NewRing[Event](10),
+		FailRing:    NewRing[Event](10),
+		Dedup:       NewDedup(time.Minute),
+	}
+	worker := &Worker{Config: &Config{}, Trackers: []*TrackerState{tracker}, Sinks: []*SinkState{sink}}
+
+	ack := &testAcknowledger{}
+	for i := 0; i < 2; i++ {
+		tracker.RequestBus <- &Delivery{Tag: uint64(i), Body: []byte(transformResults[0].request), acknowledger: ack}
+	}
+	close(tracker.RequestBus)
+	worker.Transformer()
+	worker.pipeline.Wait()
+
+	if len(sink.Buses["adjust"].Events) != 1 {
+		t.Fatalf("Duplicate must not be forwarded")
+	}
+	if len(ack.acks) != 1 || ack.acks[0] != 1 || tracker.Status().Dedup.Dropped != 1 {
+		t.Errorf("Duplicate must be dropped and acknowledged")
+	}
+
+	event := <-sink.Buses["adjust"].Events
+	event.GetDelivery().Done(errSinkDown)
+	if len(ack.nacks) != 1 || tracker.Dedup.Seen(event.DedupKey()) {
+		t.Errorf("Requeued event must be forgotten")
+	}
+}
+
+func TestTransformerDedupArchive(t *testing.T) {
+	sink := newTestSinkState(&testSink{}, 2)
+	sink.Health.Set(true)
+	archive := newTestSinkState(&testSink{}, 2)
+	archive.Raw = true
+	archive.Health.Set(true)
+
+	tracker := &TrackerState{
+		Tracker:     &AdjustTracker{},
+		RequestBus:  make(chan *Delivery, 2),
+		SuccessRing: NewRing[Event](10),
+		FailRing:    NewRing[Event](10),
+		Dedup:       NewDedup(time.Minute),
+	}
+	worker := &Worker{Config: &Config{}, Trackers: []*TrackerState{tracker}, Sinks: []*SinkState{archive, sink}}
+
+	ack := &testAcknowledger{}
+	for i := 0; i < 2; i++ {
+		tracker.RequestBus <- &Delivery{Tag: uint64(i), Body: []byte(transformResults[0].request), acknowledger: ack}
+	}
+	close(tracker.RequestBus)
+	worker.Transformer()
+	worker.pipeline.Wait()
+
+	if len(sink.Buses["adjust"].Events) != 1 || len(archive.Buses["adjust"].Events) != 2 {
+		t.Fatalf("Duplicate must be forwarded to raw sink only")
+	}
+	if len(ack.acks) != 0 {
+		t.Errorf("Duplicate must not be acknowledged before it's archived")
+	}
+
+	<-archive.Buses["adjust"].Events
+	duplicate := <-archive.Buses["adjust"].Events
+	duplicate.GetDelivery().Done(nil)
+	if len(ack.acks) != 1 || ack.acks[0] != 1 {
+		t.Errorf("Duplicate must be acknowledged once archived")
+	}
+}
+
+// panicTracker is adjust tracker panicking on every request without
+// recovering, as a tracker registered elsewhere may do
+type panicTracker struct {
+	AdjustTracker
+}
+
+func (tracker *panicTracker) Transform(request []byte) ([]Event, error) {
+	var fields []string
+	return nil, errors.New(fields[1])
+}
+
+func TestTransformerPanic(t *testing.T) {
+	sink := newTestSinkState(&testSink{}, 1)
+	sink.Health.Set(true)
+
+	tracker := &TrackerState{
+		Tracker:     &panicTracker{},
+		RequestBus:  make(chan *Delivery, 1),
+		SuccessRing: NewRing[Event](10),
+		FailRing:    NewRing[Event](10),
+	}
+	worker := &Worker{Config: &Config{}, Trackers: []*TrackerState{tracker}, Sinks: []*SinkState{sink}}
+
+	panics := metrics.TransformPanics.Get("adjust")
+	tracker.RequestBus <- &Delivery{Body: []byte(transformResults[0].request), acknowledger: &testAcknowledger{}}
+	close(tracker.RequestBus)
+	worker.Transformer()
+	worker.pipeline.Wait()
+
+	event, ok := <-sink.Buses["adjust"].Events
+	if !ok {
+		t.Fatalf("Event panicked must be written as failure")
+	}
+	adjustEvent := event.(*AdjustEvent)
+	if adjustEvent.ErrType.String != "Transform" || !strings.HasPrefix(adjustEvent.Error.String, "panic: runtime error: index out of range") {
+		t.Errorf("Unexpected failure: %s %s", adjustEvent.ErrType.String, adjustEvent.Error.String)
+	}
+	if !strings.Contains(adjustEvent.Error.String, "tracker_test.go") {
+		t.Errorf("Error must have stack trace of panic:\n%s", adjustEvent.Error.String)
+	}
+	if metrics.TransformPanics.Get("adjust") != panics+1 || tracker.FailRing.Total() != 1 {
+		t.Errorf("Panic must be counted as failure")
+	}
+}
+
+func TestTransformPanic(t *testing.T) {
+	transform := func() (err error) {
+		defer recoverTransform(&err)
+		var fields []string
+		return errors.New(fields[1])
+	}
+	err := transform()
+
+	var panicErr *PanicError
+	if !errors.As(err, &panicErr) {
+		t.Fatalf("Panic must be recovered as error, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "panic: runtime error: index out of range") || !strings.Contains(err.Error(), "tracker_test.go") {
+		t.Errorf("Error must have stack trace of panic:\n%s", err)
+	}
+	if errType := transformErrorType(err); errType != "Transform" {
+		t.Errorf("Unexpected error type: %s", errType)
+	}
+}
+
+// checkTrackerTransform fails unless tracker returns every event of request,
+// or the only event written as failure
+func checkTrackerTransform(t *testing.T, tracker Tracker, request []byte) ([]Event, error) {
+	events, err := tracker.Transform(request)
+	// Malformed requests fail without relying on recovery
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		t.Fatal(err)
+	}
+	if err != nil && len(events) != 1 || err == nil && len(events) == 0 {
+		t.Fatalf("Unexpected %d events, error: %v", len(events), err)
+	}
+	for _, event := range events {
+		if event == nil {
+			t.Fatalf("Events must not be nil, error: %v", err)
+		}
+	}
+	if err != nil {
+		events[0].SetError(transformErrorType(err), err, request)
+	}
+	return events, err
+}
+
+func FuzzAdjustTrackerTransform(f *testing.F) {
+	for _, testCase := range transformResults {
+		f.Add([]byte(testCase.request))
+	}
+	f.Add([]byte(`{\x22request\x22:\x22GET\x22}`))
+	f.Fuzz(func(t *testing.T, request []byte) {
+		events, err := checkTrackerTransform(t, &AdjustTracker{}, request)
+		if err != nil {
+			return
+		}
+
+		// Parameters present are set, whatever else is in request
+		event := events[0].(*AdjustEvent)
+		query, _ := adjustQuery(request)
+		if ip := query.Get("ip"); ip != "" && event.Ip.String != ip {
+			t.Errorf("Ip: %+v, expected %q", event.Ip, ip)
+		}
+		for name, timestamp := range map[string]NullTime{"clt": event.Clt, "it": event.It, "ct": event.Ct, "rt": event.Rt} {
+			unix, err := strconv.ParseInt(query.Get(name), 10, 64)
+			if err == nil && (!timestamp.Valid || timestamp.Time.Unix() != unix) {
+				t.Errorf("%s: %+v, expected %d", name, timestamp, unix)
+			}
+		}
+	})
+}
+
+func FuzzSnowplowTrackerTransform(f *testing.F) {
+	for _, testCase := range transformResultsSnowplow {
+		f.Add([]byte(testCase.request))
+	}
+	for _, testCase := range transformSnowplowResults {
+		f.Add([]byte(testCase.request))
+	}
+	for _, testCase := range snowplowBase64Results {
+		f.Add([]byte(testCase.request))
+	}
+	f.Fuzz(func(t *testing.T, request []byte) {
+		events, err := checkTrackerTransform(t, &SnowplowTracker{}, request)
+		if err != nil {
+			return
+		}
+
+		// Fields present are set, whatever else is in request
+		snowplowRequest, _ := parseSnowplowRequest(request)
+		for i, event := range events {
+			event := event.(*SnowplowEvent)
+			if ip := snowplowRequest.IPAddress; ip != "" && event.UserIP.String != ip {
+				t.Errorf("UserIP: %+v, expected %q", event.UserIP, ip)
+			}
+			if event.CollectorTstamp.IsZero() {
+				t.Errorf("CollectorTstamp must be set")
+			}
+			if dvceTstamp := snowplowRequest.RequestBody.Data[i].DvceTstamp.Time; !event.DvceTstamp.Equal(dvceTstamp) {
+				t.Errorf("DvceTstamp: %s, expected %s", event.DvceTstamp, dvceTstamp)
+			}
+		}
+	})
+}
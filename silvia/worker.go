@@ -2,12 +2,13 @@ package silvia
 
 import (
 	"bytes"
-	"database/sql/driver"
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"reflect"
 	"strconv"
 	"strings"
@@ -15,11 +16,12 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/abh/geoip"
 	consul "github.com/hashicorp/consul/api"
 	"github.com/satori/go.uuid"
 )
 
+var errNoWriters = errors.New("No healthy writers for event")
+
 type (
 	Health struct {
 		sync.RWMutex
@@ -27,52 +29,30 @@ type (
 	}
 
 	Stats struct {
-		AdjustSuccessRing   *AdjustRing
-		AdjustFailRing      *AdjustRing
-		SnowplowSuccessRing *SnowplowRing
-		SnowplowFailRing    *SnowplowRing
-
-		RedshiftAdjustSuccessRing   *AdjustRing
-		RedshiftAdjustFailRing      *AdjustRing
-		RedshiftSnowplowSuccessRing *SnowplowRing
-		RedshiftSnowplowFailRing    *SnowplowRing
-
-		PostgresAdjustSuccessRing   *AdjustRing
-		PostgresAdjustFailRing      *AdjustRing
-		PostgresSnowplowSuccessRing *SnowplowRing
-		PostgresSnowplowFailRing    *SnowplowRing
-
-		StartTime      time.Time
-		RabbitHealth   Health
-		PostgresHealth Health
-		RedshiftHealth Health
-	}
-
-	Config struct {
-		PostgresEnabled string `consul:"postgres_enabled"`
-		RedshiftEnabled string `consul:"redshift_enabled"`
-		Port            string `consul:"port"`
-		PostgresConnect string `consul:"postgres_connect"`
-		RedshiftConnect string `consul:"redshift_connect"`
-		RingSize        string `consul:"ring_size"`
-		RabbitAddr      string `consul:"rabbit_addr"`
-		RabbitPort      string `consul:"rabbit_port"`
+		StartTime    time.Time
+		RabbitHealth Health
 	}
 
 	Worker struct {
-		Config                   *Config
-		Stats                    *Stats
-		AdjustRequestBus         chan []byte
-		SnowplowRequestBus       chan []byte
-		AdjustErrorBus           chan *AdjustEvent
-		SnowplowErrorBus         chan *SnowplowEvent
-		PostgresAdjustEventBus   chan *AdjustEvent
-		PostgresSnowplowEventBus chan *SnowplowEvent
-		RedshiftAdjustEventBus   chan *AdjustEvent
-		RedshiftSnowplowEventBus chan *SnowplowEvent
-		GeoDB                    *geoip.GeoIP
-		ConsulAgent              *consul.Agent
-		ConsulServiceID          string
+		Config          *Config
+		ConfigPath      string
+		Stats           *Stats
+		Trackers        []*TrackerState
+		Sinks           []*SinkState
+		ConsulAgent     *consul.Agent
+		ConsulServiceID string
+		DrainTimeout    time.Duration
+		ConfigChanges   *Ring[ConfigChange]
+
+		ctx         context.Context
+		stop        context.CancelFunc
+		replaying   bool
+		consul      *consul.Client
+		localConfig *Config
+		desired     *Config
+		sinksLock   sync.RWMutex
+		pipeline    sync.WaitGroup
+		rabbit      *Rabbit
 	}
 )
 
@@ -88,87 +68,53 @@ func (health *Health) Get() bool {
 	return health.Health
 }
 
-func (config *Config) fillFromConsul(client *consul.Client, appName string) error {
-	kv := client.KV()
-
-	structType := reflect.TypeOf(*config)
-	structValue := reflect.ValueOf(config).Elem()
-
-	for i := 0; i < structType.NumField(); i++ {
-		field := structType.Field(i)
-		consulKey := field.Tag.Get("consul")
-		pair, _, err := kv.Get(appName+"/"+consulKey, nil)
-		if pair == nil {
-			return err
-		}
-		consulValue := string(pair.Value)
-		structValue.FieldByName(field.Name).SetString(consulValue)
-	}
-
-	return nil
-}
-
-func (worker *Worker) Load() error {
-	worker.Config = &Config{}
-
+// loadPipeline resolves config and creates trackers and sinks
+func (worker *Worker) loadPipeline() error {
 	var err error
-	worker.GeoDB, err = geoip.Open("GeoLiteCity.dat")
+	worker.localConfig, err = loadLocalConfig(worker.ConfigPath)
 	if err != nil {
 		return err
 	}
-
-	consulConfig := &consul.Config{
-		Address:    "127.0.0.1:8500",
-		Scheme:     "http",
-		HttpClient: http.DefaultClient,
-	}
-
-	client, err := consul.NewClient(consulConfig)
+	worker.Config, worker.consul, err = resolveConfig(worker.localConfig)
 	if err != nil {
 		return err
 	}
+	worker.desired = worker.Config.clone()
+	worker.ConfigChanges = NewRing[ConfigChange](configChangesSize)
 
-	err = worker.Config.fillFromConsul(client, "silvia")
+	worker.Stats = &Stats{StartTime: time.Now()}
+	worker.DrainTimeout = worker.Config.DrainTimeout
+	worker.ctx, worker.stop = context.WithCancel(context.Background())
+
+	worker.Trackers, err = newTrackers(worker.Config, worker.Config.RingSize)
 	if err != nil {
 		return err
 	}
 
-	ringSize, err := strconv.Atoi(worker.Config.RingSize)
+	worker.Sinks, err = newSinks(worker.Config, worker.Trackers, worker.Config.RingSize)
 	if err != nil {
 		return err
 	}
-
-	worker.Stats = &Stats{
-		AdjustSuccessRing:   &AdjustRing{Size: ringSize},
-		AdjustFailRing:      &AdjustRing{Size: ringSize},
-		SnowplowSuccessRing: &SnowplowRing{Size: ringSize},
-		SnowplowFailRing:    &SnowplowRing{Size: ringSize},
-
-		RedshiftAdjustSuccessRing:   &AdjustRing{Size: ringSize},
-		RedshiftAdjustFailRing:      &AdjustRing{Size: ringSize},
-		RedshiftSnowplowSuccessRing: &SnowplowRing{Size: ringSize},
-		RedshiftSnowplowFailRing:    &SnowplowRing{Size: ringSize},
-
-		PostgresAdjustSuccessRing:   &AdjustRing{Size: ringSize},
-		PostgresAdjustFailRing:      &AdjustRing{Size: ringSize},
-		PostgresSnowplowSuccessRing: &SnowplowRing{Size: ringSize},
-		PostgresSnowplowFailRing:    &SnowplowRing{Size: ringSize},
+	for _, sink := range worker.Sinks {
+		err = worker.openSpill(sink)
+		if err != nil {
+			return err
+		}
 	}
 
-	worker.Stats.StartTime = time.Now()
-
-	worker.AdjustRequestBus = make(chan []byte)
-	worker.SnowplowRequestBus = make(chan []byte)
-	worker.PostgresAdjustEventBus = make(chan *AdjustEvent)
-	worker.PostgresSnowplowEventBus = make(chan *SnowplowEvent)
-	worker.RedshiftAdjustEventBus = make(chan *AdjustEvent, 50)
-	worker.RedshiftSnowplowEventBus = make(chan *SnowplowEvent, 300)
-
-	worker.AdjustErrorBus = make(chan *AdjustEvent, 15)
-	worker.SnowplowErrorBus = make(chan *SnowplowEvent, 15)
+	return nil
+}
 
-	port, err := strconv.Atoi(worker.Config.Port)
+// Load resolves config, builds the pipeline and registers the service
+// in Consul unless it's disabled
+func (worker *Worker) Load() error {
+	err := worker.loadPipeline()
 	if err != nil {
+		return err
+	}
+
+	if worker.consul == nil || !worker.Config.ConsulRegister {
+		log.Println("Consul registration disabled")
 		return nil
 	}
 
@@ -179,7 +125,7 @@ func (worker *Worker) Load() error {
 			TTL: "10s",
 		},
 		&consul.AgentServiceCheck{
-			HTTP:     "http://localhost:" + worker.Config.Port + "/v1/status",
+			HTTP:     "http://localhost:" + strconv.Itoa(worker.Config.Port) + "/v1/status",
 			Interval: "10s",
 			Timeout:  "1s",
 		},
@@ -188,11 +134,11 @@ func (worker *Worker) Load() error {
 	service := &consul.AgentServiceRegistration{
 		ID:     worker.ConsulServiceID,
 		Name:   "silvia",
-		Port:   port,
+		Port:   worker.Config.Port,
 		Checks: checks,
 	}
 
-	worker.ConsulAgent = client.Agent()
+	worker.ConsulAgent = worker.consul.Agent()
 	err = worker.ConsulAgent.ServiceRegister(service)
 	if err != nil {
 		return err
@@ -214,6 +160,14 @@ func (worker *Worker) Load() error {
 }
 
 func (worker *Worker) Generator() {
+	worker.pipeline.Add(1)
+	defer worker.pipeline.Done()
+	defer func() {
+		for _, tracker := range worker.Trackers {
+			close(tracker.RequestBus)
+		}
+	}()
+
 	for {
 		rabbit := &Rabbit{}
 		err := rabbit.Connect(worker.Config)
@@ -221,417 +175,303 @@ func (worker *Worker) Generator() {
 			log.Println("Can't connect to RabbitMQ! Retry after 5s")
 		} else {
 			rabbit.Channel, err = rabbit.Connection.Channel()
+			if err == nil {
+				err = rabbit.Channel.Qos(rabbitPrefetch, 0, false)
+			}
+			if err == nil && worker.Config.DeadLetterExchange != "" {
+				rabbit.DeadLetters, err = NewDeadLetters(rabbit.Connection, worker.Config.DeadLetterExchange)
+			}
 			if err != nil {
 				log.Println("Can't create RabbitMQ channel! Retry after 5s")
 			} else {
 				worker.Stats.RabbitHealth.Set(true)
-				rabbit.ConsFailChan = make(chan bool)
-				go rabbit.Consume("adjust", worker.AdjustRequestBus)
-				go rabbit.Consume("snowplow", worker.SnowplowRequestBus)
+				rabbit.ConsFailChan = make(chan bool, len(worker.Trackers))
+				for _, tracker := range worker.Trackers {
+					go rabbit.Consume(worker.ctx, tracker.Tracker.Queue(), tracker.RequestBus)
+				}
 				<-rabbit.ConsFailChan
+
+				if worker.ctx.Err() != nil {
+					// Keep the connection open, writers still have to
+					// acknowledge messages which are already consumed
+					for i := 1; i < len(worker.Trackers); i++ {
+						<-rabbit.ConsFailChan
+					}
+					worker.rabbit = rabbit
+					return
+				}
 				rabbit.Channel.Close()
+				for i := 1; i < len(worker.Trackers); i++ {
+					<-rabbit.ConsFailChan
+				}
 			}
 			rabbit.Connection.Close()
 		}
 
 		worker.Stats.RabbitHealth.Set(false)
-		time.Sleep(5 * time.Second)
+		select {
+		case <-worker.ctx.Done():
+			return
+		case <-time.After(5 * time.Second):
+		}
 	}
 }
 
 func (worker *Worker) Transformer() {
-	go func() {
-		for {
-			rawEvent := <-worker.AdjustRequestBus
-			adjustEvent := &AdjustEvent{}
-			err := adjustEvent.Transform(rawEvent)
-			if err != nil {
-				worker.Stats.AdjustFailRing.Add(adjustEvent, err)
-				checkStringForNull("Transform", &adjustEvent.ErrType)
-				checkStringForNull(strings.Replace(err.Error(), "'", "''", -1), &adjustEvent.Error)
-				checkStringForNull(strings.Replace(fmt.Sprintf("%#v", string(rawEvent)), "'", "''", -1), &adjustEvent.ErrorEvent)
-				worker.AdjustErrorBus <- adjustEvent
-			} else {
-				if worker.Stats.PostgresHealth.Get() {
-					worker.PostgresAdjustEventBus <- adjustEvent
-				}
-				if worker.Stats.RedshiftHealth.Get() {
-					worker.RedshiftAdjustEventBus <- adjustEvent
+	for _, tracker := range worker.Trackers {
+		worker.pipeline.Add(1)
+		go func(tracker *TrackerState) {
+			name := tracker.Tracker.Name()
+			defer worker.pipeline.Done()
+			defer func() {
+				for _, sink := range worker.sinks() {
+					sink.Buses[name].Close()
 				}
-			}
-		}
-	}()
+			}()
 
-	go func() {
-		for {
-			rawEvent := <-worker.SnowplowRequestBus
-			snowplowEvent := &SnowplowEvent{}
-			err := snowplowEvent.Transform(rawEvent, worker.GeoDB)
-			if err != nil {
-				worker.Stats.SnowplowFailRing.Add(snowplowEvent, err)
+			for delivery := range tracker.RequestBus {
+				metrics.Consumed.Inc(name)
+				delivery.Tracker = name
 
-				checkStringForNull("error", &snowplowEvent.EventID)
-				checkStringForNull("Transform", &snowplowEvent.ErrType)
-				checkStringForNull(strings.Replace(err.Error(), "'", "''", -1), &snowplowEvent.Error)
-				checkStringForNull(strings.Replace(fmt.Sprintf("%#v", string(rawEvent)), "'", "''", -1), &snowplowEvent.ErrorEvent)
-				worker.SnowplowErrorBus <- snowplowEvent
-			} else {
-				if worker.Stats.PostgresHealth.Get() {
-					worker.PostgresSnowplowEventBus <- snowplowEvent
+				rawEvent := delivery.Body
+				start := time.Now()
+				events, err := transform(tracker.Tracker, rawEvent)
+				metrics.TransformLatency.Since(start, name)
+
+				for _, event := range events {
+					event.SetDelivery(delivery)
 				}
-				if worker.Stats.RedshiftHealth.Get() {
-					worker.RedshiftSnowplowEventBus <- snowplowEvent
+				unseen := events
+				// Events are read by /v1/ring, so they are added to rings
+				// only when complete
+				if err != nil {
+					metrics.TransformFailed.Inc(name)
+					var panicErr *PanicError
+					if errors.As(err, &panicErr) {
+						metrics.TransformPanics.Inc(name)
+						log.Printf("Recovered %s transform of delivery %d: %s", name, delivery.Tag, err)
+					}
+					errType := transformErrorType(err)
+					events[0].SetError(errType, err, rawEvent)
+					tracker.FailRing.Add(events[0], err)
+
+					// Dead-lettered and replayed messages are not written
+					// as failure rows, they stay in their source
+					if worker.Config.DeadLetterExchange != "" || worker.replaying {
+						delivery.Add(1)
+						delivery.Done(&StageError{Stage: StageTransform, Type: errType, Err: err})
+						continue
+					}
+				} else {
+					metrics.Transformed.Add(float64(len(events)), name)
+					unseen = worker.dedup(tracker, delivery, events)
 				}
+
+				// Hold the delivery until it is handed over to every sink
+				delivery.Add(1)
+				delivery.Done(worker.forward(name, delivery, events, unseen))
 			}
-		}
-	}()
+		}(tracker)
+	}
 }
 
-func (worker *Worker) Writer(driver string) {
-
-	switch driver {
+// dedup drops events of delivery seen by tracker within the window and
+// adds the rest to success ring
+func (worker *Worker) dedup(tracker *TrackerState, delivery *Delivery, events []Event) []Event {
+	var keys []string
+	var unseen []Event
+	for i, event := range events {
+		key := event.DedupKey()
+		if tracker.Dedup.Seen(key) {
+			metrics.Duplicates.Inc(tracker.Tracker.Name())
+			delivery.dropped = append(delivery.dropped, i)
+			continue
+		}
+		keys = append(keys, key)
+		unseen = append(unseen, event)
+		tracker.SuccessRing.Add(event, nil)
+	}
 
-	case "postgres":
+	if tracker.Dedup != nil {
+		// Redelivery of requeued message is not a duplicate
+		delivery.onRequeue = func() {
+			for _, key := range keys {
+				tracker.Dedup.Forget(key)
+			}
+		}
+	}
+	return unseen
+}
 
-		if worker.Config.PostgresEnabled == "true" {
+// forward sends unseen events of tracker built from delivery to every
+// sink, raw sinks get all of them so messages of duplicates are archived
+// too. Sinks which are down keep raw messages in their spills along with
+// events dropped as duplicates, or buffer events
+// in their buses if spill is disabled or full. Forwarding stalls once a bus
+// is full and messages wait in RabbitMQ. Returns errNoWriters if no sink
+// getting events is healthy or spilling, so the message gets requeued.
+// Disabled sinks are skipped.
+func (worker *Worker) forward(tracker string, delivery *Delivery, events []Event, unseen []Event) error {
+	worker.sinksLock.RLock()
+	defer worker.sinksLock.RUnlock()
+
+	sinkEvents := func(sink *SinkState) []Event {
+		if sink.Raw {
+			return events
+		}
+		return unseen
+	}
 
-			postgres := &Postgres{}
-			err := postgres.Connect(worker.Config)
+	receiving, writable := false, false
+	for _, sink := range worker.Sinks {
+		if len(sinkEvents(sink)) > 0 {
+			receiving = true
+			writable = writable || sink.Health.Get() || sink.Spill != nil
+		}
+	}
+	if !receiving {
+		return nil
+	}
+	if !writable {
+		return errNoWriters
+	}
 
-			if err != nil {
-				log.Println("Can't connect to PostgreSQL! Retry after 5s")
-			} else {
+	for _, sink := range worker.Sinks {
+		events := sinkEvents(sink)
+		if len(events) == 0 {
+			continue
+		}
+		if sink.spilling() {
+			record := newArchiveRecord(delivery)
+			if !sink.Raw {
+				record.Dropped = delivery.dropped
+			}
+			err := sink.Spill.Append(record)
+			if err == nil {
+				metrics.Spilled.Add(float64(len(events)), sink.Name, tracker)
+				continue
+			}
+			log.Printf("Can't spill %s event for %s: %s", tracker, sink.Name, err)
+		}
 
-				worker.Stats.PostgresHealth.Set(true)
-				go func() {
-					defer postgres.Connection.Db.Close()
-					for {
-						adjustEvent := <-worker.PostgresAdjustEventBus
-						err := postgres.Connection.Insert(adjustEvent)
-						if err != nil {
-							worker.Stats.PostgresAdjustFailRing.Add(adjustEvent, err)
-						} else {
-							worker.Stats.PostgresAdjustSuccessRing.Add(adjustEvent, err)
-						}
-					}
-				}()
-
-				go func() {
-					defer postgres.Connection.Db.Close()
-					for {
-						snowplowEvent := <-worker.PostgresSnowplowEventBus
-						err := postgres.Connection.Insert(snowplowEvent)
-						if err != nil {
-							worker.Stats.PostgresSnowplowFailRing.Add(snowplowEvent, err)
-						} else {
-							worker.Stats.PostgresSnowplowSuccessRing.Add(snowplowEvent, err)
-						}
-					}
-				}()
+		for _, event := range events {
+			delivery.Add(1)
+			select {
+			case sink.Buses[tracker].Events <- event:
+			case <-sink.disabled:
+				delivery.Done(nil)
 			}
 		}
-	case "redshift":
+	}
+	return nil
+}
 
-		redshift := &Redshift{}
+// Writer runs every sink enabled in config
+func (worker *Worker) Writer() {
+	worker.sinksLock.RLock()
+	defer worker.sinksLock.RUnlock()
+	for _, sink := range worker.Sinks {
+		worker.runSink(sink)
+	}
+}
 
-		if worker.Config.RedshiftEnabled == "true" {
-			err := redshift.Connect(worker.Config)
-			if err != nil {
-				log.Println("Can't connect to Redshift! Retry after 5s")
-			} else {
+// runSink starts sink, sinksLock must be held
+func (worker *Worker) runSink(sink *SinkState) {
+	sink.started = true
+	worker.pipeline.Add(1)
+	go func() {
+		defer worker.pipeline.Done()
+		defer close(sink.stopped)
+		sink.Run(worker.ctx, worker.Config)
+	}()
+}
 
-				// Create tablemaps for adjust and atomic
-				snowplowTmap := redshift.Connection.AddTableWithNameAndSchema(SnowplowEvent{}, "atomic", "events")
-				adjustTmap := redshift.Connection.AddTableWithNameAndSchema(AdjustEvent{}, "adjust", "events")
-
-				snowplowInsert := fmt.Sprintf("INSERT INTO \"%s\".\"%s\" ( \"%s\" ) values ", "atomic", "events", strings.Join(GetColumns(snowplowTmap)[2:], "\", \""))
-				adjustInsert := fmt.Sprintf("INSERT INTO \"%s\".\"%s\" (\"%s\") values ", "adjust", "events", strings.Join(GetColumns(adjustTmap)[2:], "\", \""))
-
-				worker.Stats.RedshiftHealth.Set(true)
-				go func() {
-					defer redshift.Connection.Db.Close()
-					for {
-						var query bytes.Buffer
-						query.WriteString(adjustInsert)
-
-						remains := 30
-						i := 0
-						for event := range worker.RedshiftAdjustEventBus {
-							i++
-							// event := <-worker.RedshiftAdjustEventBus
-							stringEvent, err := getStringEventValues(event)
-
-							if err != nil {
-								worker.Stats.RedshiftAdjustFailRing.Add(event, err)
-								checkStringForNull("GetStringEventValues", &event.ErrType)
-								checkStringForNull(strings.Replace(err.Error(), "'", "''", -1), &event.Error)
-								checkStringForNull(strings.Replace(fmt.Sprintf("%#v", event), "'", "''", -1), &event.ErrorEvent)
-								worker.AdjustErrorBus <- event
-								continue
-							}
-
-							_, err = query.WriteString(stringEvent)
-
-							if err != nil {
-								worker.Stats.RedshiftAdjustFailRing.Add(event, err)
-								checkStringForNull("WriteString", &event.ErrType)
-								checkStringForNull(strings.Replace(err.Error(), "'", "''", -1), &event.Error)
-								checkStringForNull(strings.Replace(fmt.Sprintf("%#v", event), "'", "''", -1), &event.ErrorEvent)
-								worker.AdjustErrorBus <- event
-								break
-							}
-							worker.Stats.RedshiftAdjustSuccessRing.Add(event, err)
-
-							if i == remains {
-								break
-							}
-							query.WriteString(", ")
-
-						}
-
-						query.WriteString(";")
-						_, err = redshift.Connection.Exec(query.String())
-
-						if err != nil {
-							worker.Stats.RedshiftAdjustFailRing.Add(&AdjustEvent{}, err)
-							event := &AdjustEvent{}
-
-							checkStringForNull("ExecQuery", &event.ErrType)
-							checkStringForNull(strings.Replace(err.Error(), "'", "''", -1), &event.Error)
-							checkStringForNull(strings.Replace(fmt.Sprintf("%#v", query.String()), "'", "''", -1), &event.ErrorEvent)
-							worker.AdjustErrorBus <- event
-							fmt.Println("ERROR ", err, " ", query.String())
-						} else {
-							worker.Stats.RedshiftAdjustSuccessRing.Add(&AdjustEvent{}, err)
-						}
-					}
-				}()
-
-				go func() {
-					defer redshift.Connection.Db.Close()
-					for {
-						var query bytes.Buffer
-						query.WriteString(adjustInsert)
-
-						remains := 1
-						i := 0
-						for event := range worker.AdjustErrorBus {
-							i++
-							// event := <-worker.RedshiftAdjustEventBus
-							stringEvent, err := getStringEventValues(event)
-
-							if err != nil {
-								log.Println(event)
-								log.Println(err)
-								continue
-							}
-
-							_, err = query.WriteString(stringEvent)
-
-							if err != nil {
-								log.Println(stringEvent)
-								log.Println(err)
-								break
-							}
-
-							if i == remains {
-								break
-							}
-							query.WriteString(", ")
-
-						}
-
-						query.WriteString(";")
-						_, err = redshift.Connection.Exec(query.String())
-						if err != nil {
-							log.Println(query.String())
-							log.Println(err)
-						}
-					}
-				}()
-
-				go func() {
-					defer redshift.Connection.Db.Close()
-					for {
-						var query bytes.Buffer
-						query.WriteString(snowplowInsert)
-						i := 0
-						remains := 50
-						for event := range worker.RedshiftSnowplowEventBus {
-							i++
-							// for i := 0; i < remains; i++ {
-							// event := <-worker.RedshiftSnowplowEventBus
-							stringEvent, err := getStringEventValues(event)
-
-							if err != nil {
-								worker.Stats.RedshiftSnowplowFailRing.Add(event, err)
-								checkStringForNull("error", &event.EventID)
-								checkStringForNull("GetStringEventValues", &event.ErrType)
-								checkStringForNull(strings.Replace(err.Error(), "'", "''", -1), &event.Error)
-								checkStringForNull(strings.Replace(fmt.Sprintf("%#v", event), "'", "''", -1), &event.ErrorEvent)
-								worker.SnowplowErrorBus <- event
-								continue
-							}
-
-							_, err = query.WriteString(stringEvent)
-
-							if err != nil {
-								worker.Stats.RedshiftSnowplowFailRing.Add(event, err)
-								checkStringForNull("error", &event.EventID)
-								checkStringForNull("WriteString", &event.ErrType)
-								checkStringForNull(strings.Replace(err.Error(), "'", "''", -1), &event.Error)
-								checkStringForNull(strings.Replace(fmt.Sprintf("%#v", event), "'", "''", -1), &event.ErrorEvent)
-								worker.SnowplowErrorBus <- event
-								break
-							}
-							worker.Stats.RedshiftSnowplowSuccessRing.Add(event, err)
-
-							if i == remains {
-								break
-							}
-							query.WriteString(", ")
-						}
-
-						query.WriteString(";")
-
-						_, err = redshift.Connection.Exec(query.String())
-
-						if err != nil {
-							event := &SnowplowEvent{}
-							worker.Stats.RedshiftSnowplowFailRing.Add(event, err)
-
-							checkStringForNull("error", &event.EventID)
-							checkStringForNull("ExecQuery", &event.ErrType)
-							checkStringForNull(strings.Replace(err.Error(), "'", "''", -1), &event.Error)
-							checkStringForNull(strings.Replace(fmt.Sprintf("%#v", query.String()), "'", "''", -1), &event.ErrorEvent)
-							worker.SnowplowErrorBus <- event
-						} else {
-							worker.Stats.RedshiftSnowplowSuccessRing.Add(&SnowplowEvent{}, err)
-						}
-					}
-				}()
-
-				go func() {
-					defer redshift.Connection.Db.Close()
-					for {
-						var query bytes.Buffer
-						query.WriteString(snowplowInsert)
-
-						remains := 1
-						i := 0
-						for event := range worker.SnowplowErrorBus {
-							i++
-							// event := <-worker.RedshiftAdjustEventBus
-							stringEvent, err := getStringEventValues(event)
-
-							if err != nil {
-								log.Println(event)
-								log.Println(err)
-								continue
-							}
-
-							_, err = query.WriteString(stringEvent)
-
-							if err != nil {
-								log.Println(stringEvent)
-								log.Println(err)
-								break
-							}
-
-							if i == remains {
-								break
-							}
-							query.WriteString(", ")
-
-						}
-
-						query.WriteString(";")
-						_, err = redshift.Connection.Exec(query.String())
-						if err != nil {
-							log.Println(query.String())
-							log.Println(err)
-						}
-					}
-				}()
-			}
+// openSpill opens spill of sink in spill_dir, unless it's not set or
+// worker replays
+func (worker *Worker) openSpill(sink *SinkState) error {
+	if worker.Config.SpillDir == "" || worker.replaying {
+		return nil
+	}
 
-		}
+	var err error
+	dir := filepath.Join(worker.Config.SpillDir, sink.Name)
+	sink.Spill, err = OpenSpill(dir, int64(worker.Config.SpillMaxBytes), int64(worker.Config.SpillSegmentBytes))
+	if err != nil {
+		return fmt.Errorf("Can't open %s spill: %s", sink.Name, err)
+	}
+	return nil
+}
 
+// sinks returns copy of enabled sinks, they can change on config reload
+func (worker *Worker) sinks() []*SinkState {
+	worker.sinksLock.RLock()
+	defer worker.sinksLock.RUnlock()
+	return append([]*SinkState(nil), worker.Sinks...)
+}
+
+// Shutdown stops consuming from RabbitMQ and waits until every event
+// already consumed is transformed and written, partial batches flushed
+// and sinks closed. Returns ctx error if the drain
+// deadline is exceeded, unacknowledged messages are requeued by RabbitMQ.
+func (worker *Worker) Shutdown(ctx context.Context) error {
+	// Sinks are not started by config reload once shutdown begins
+	worker.sinksLock.Lock()
+	worker.stop()
+	worker.sinksLock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		worker.pipeline.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 
-	// worker.Stats.PostgresHealth.Set(false)
-	time.Sleep(3 * time.Second)
+	if worker.rabbit != nil {
+		worker.rabbit.Connection.Close()
+	}
+	return nil
 }
 
 func (worker *Worker) Killer() {
 	signalCh := make(chan os.Signal, 4)
 	signal.Notify(signalCh, os.Interrupt, syscall.SIGTERM)
 	<-signalCh
-	worker.ConsulAgent.ServiceDeregister(worker.ConsulServiceID)
+
+	log.Println("Shutting down, draining events for", worker.DrainTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), worker.DrainTimeout)
+	err := worker.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		log.Println("Can't drain events:", err)
+	}
+
+	if worker.ConsulAgent != nil {
+		worker.ConsulAgent.ServiceDeregister(worker.ConsulServiceID)
+	}
 	os.Exit(0)
 }
 
+// getEventValues returns values of columns of event, rows given as values
+// are returned as is
 func getEventValues(event interface{}) []interface{} {
-	var values []interface{}
-	e := reflect.ValueOf(event).Elem()
-	for i := 2; i < e.NumField(); i++ {
-		// if strings.Contains(e.Type().Field(i).Type.String(), "sql.") {
-		// 	values = append(values, e.Field(i).Field(0).Interface())
-		// 	continue
-		// }
-		values = append(values, e.Field(i).Interface())
+	if row, isRow := event.([]interface{}); isRow {
+		return row
 	}
-	return values
-}
-
-func getStringEventValues(event interface{}) (string, error) {
-
-	var values bytes.Buffer
 
+	var values []interface{}
 	e := reflect.ValueOf(event).Elem()
-	values.WriteString("( ")
-
-	formatString := "'%v', "
-
-	for i := 2; i < e.NumField(); i++ {
-
-		if i == e.NumField()-1 {
-			formatString = "'%v' )"
-		}
-		// fmt.Println(e.Field(i).Type().String())
-		if e.Field(i).Type().String() == "silvia.NullTime" {
-			time := e.Field(i).Field(0).MethodByName("Format").Call([]reflect.Value{reflect.ValueOf(time.RFC3339Nano)})[0]
-			values.WriteString(fmt.Sprintf(formatString, time))
+	for i := 0; i < e.NumField(); i++ {
+		if e.Type().Field(i).Tag.Get("db") == "-" {
 			continue
 		}
-
-		if e.Field(i).Type().String() == "time.Time" {
-			time := e.Field(i).MethodByName("Format").Call([]reflect.Value{reflect.ValueOf(time.RFC3339Nano)})[0]
-			values.WriteString(fmt.Sprintf(formatString, time))
-			continue
-		}
-
-		val, err := driver.DefaultParameterConverter.ConvertValue(e.Field(i).Interface())
-
-		if err != nil {
-			return "", err
-		}
-
-		if val == nil {
-			if i == e.NumField()-1 {
-				values.WriteString(fmt.Sprintf("%v )", "NULL"))
-				continue
-			}
-
-			values.WriteString(fmt.Sprintf("%v, ", "NULL"))
-			continue
-		}
-
-		values.WriteString(fmt.Sprintf(formatString, val))
-
+		values = append(values, e.Field(i).Interface())
 	}
-
-	return values.String(), nil
+	return values
 }
 
 func TypeConverter(val interface{}) (newval interface{}) {
@@ -647,3 +487,23 @@ func makeRange(min, max int) []string {
 	}
 	return a
 }
+
+// batchInsert builds multi-row INSERT of events into schema.table with
+// every value passed as bind parameter.
+func batchInsert(schema string, table string, columns []string, events []interface{}) (string, []interface{}) {
+	var query bytes.Buffer
+	var args []interface{}
+
+	query.WriteString(fmt.Sprintf("INSERT INTO \"%s\".\"%s\" (\"%s\") values ", schema, table, strings.Join(columns, "\", \"")))
+	for i, event := range events {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		values := getEventValues(event)
+		query.WriteString("(" + strings.Join(makeRange(len(args)+1, len(args)+len(values)), ", ") + ")")
+		args = append(args, values...)
+	}
+	query.WriteString(";")
+
+	return query.String(), args
+}
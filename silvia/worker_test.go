@@ -0,0 +1,76 @@
+package silvia
+
+import (
+	"database/sql"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBatchInsert(t *testing.T) {
+	hostile := `Robert'); DROP TABLE atomic.events; --`
+
+	first := &SnowplowEvent{}
+	checkStringForNull(hostile, &first.PageTtile)
+	second := &SnowplowEvent{}
+	checkStringForNull("https://qlean.ru/?utm_source=it's", &second.PageURL)
+
+	columns := GetColumns(snowplowTableMap())
+	query, args := batchInsert("atomic", "events", columns, []interface{}{first, second})
+
+	if len(args) != 2*len(columns) {
+		t.Fatalf("Expected %d args, got %d", 2*len(columns), len(args))
+	}
+	if strings.Contains(query, "'") {
+		t.Errorf("Query must not contain literals: %s", query)
+	}
+	if !strings.HasPrefix(query, `INSERT INTO "atomic"."events" ("app_id", "platform", `) {
+		t.Errorf("Unexpected query start: %.60s", query)
+	}
+	if !strings.Contains(query, "($1, $2, ") || !strings.HasSuffix(query, "$"+strconv.Itoa(2*len(columns))+");") {
+		t.Errorf("Unexpected placeholders: %s", query)
+	}
+
+	var found bool
+	for _, arg := range args {
+		if arg == (sql.NullString{String: hostile, Valid: true}) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Page title must be passed as is in args")
+	}
+}
+
+func TestInsertRowsChunks(t *testing.T) {
+	columns := GetColumns(snowplowTableMap())
+	rows := maxBindParams / len(columns)
+	events := make([]interface{}, 2*rows+1)
+	for i := range events {
+		events[i] = &SnowplowEvent{}
+	}
+
+	db := &testExecer{}
+	if err := insertRows(db, "atomic", "events", columns, events); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.args) != 3 || db.args[0] != rows*len(columns) || db.args[2] != len(columns) {
+		t.Errorf("Rows must be inserted in statements within %d bind parameters, got %v", maxBindParams, db.args)
+	}
+}
+
+func TestBatchRowsMax(t *testing.T) {
+	columns := len(GetColumns(snowplowTableMap()))
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if !strings.HasSuffix(field.Name, "BatchRows") {
+			continue
+		}
+		max, err := strconv.Atoi(field.Tag.Get("max"))
+		if err != nil || 2*max > rabbitPrefetch || max*columns > maxBindParams {
+			t.Errorf("Failed on: %s\nMax batch rows must fit prefetch and bind parameters, got %q", field.Name, field.Tag.Get("max"))
+		}
+	}
+}